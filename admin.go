@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// requireAdmin guards an admin-only handler with HTTP basic auth against
+// AdminUser and AdminPass. Without both set, admin handlers are disabled
+// and respond 404.
+func (a *app) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.AdminUser == "" || a.AdminPass == "" {
+			w.WriteHeader(404)
+			w.Write([]byte("Not Found"))
+			return
+		}
+
+		if !a.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="hidden-polls admin"`)
+			w.WriteHeader(401)
+			w.Write([]byte("Unauthorized"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// isAdmin reports whether r carries valid admin credentials.
+func (a *app) isAdmin(r *http.Request) bool {
+	if a.AdminUser == "" || a.AdminPass == "" {
+		return false
+	}
+
+	user, pass, ok := r.BasicAuth()
+	return ok && a.adminCredentials(user, pass)
+}
+
+// adminCredentials compares user and pass to the admin credentials in
+// constant time. Both are hashed first so their lengths don't leak either,
+// and both are always compared.
+func (a *app) adminCredentials(user, pass string) bool {
+	hash := func(s string) []byte {
+		sum := sha256.Sum256([]byte(s))
+		return sum[:]
+	}
+
+	userOK := subtle.ConstantTimeCompare(hash(user), hash(a.AdminUser))
+	passOK := subtle.ConstantTimeCompare(hash(pass), hash(a.AdminPass))
+	return userOK&passOK == 1
+}
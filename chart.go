@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"net/http"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	chartWidth      = 640
+	chartPadding    = 10
+	chartRowHeight  = 24
+	chartBarHeight  = 16
+	chartLabelChars = 24
+	chartValueChars = 16
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartText       = color.RGBA{0x3f, 0x3f, 0x44, 0xff}
+	chartBar        = color.RGBA{0x79, 0x58, 0x9f, 0xff}
+	chartTrack      = color.RGBA{0xee, 0xee, 0xf2, 0xff}
+)
+
+// renderChart draws res as a horizontal bar chart, one bar per choice with
+// its width proportional to the choice's share of the vote.
+func renderChart(res *result) *image.RGBA {
+	face := basicfont.Face7x13
+	charWidth := face.Advance
+
+	rows := len(res.Summaries)
+	if rows == 0 {
+		rows = 1
+	}
+	height := chartPadding*2 + chartRowHeight*(rows+1)
+
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(chartBackground), image.Point{}, draw.Src)
+
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(chartText), Face: face}
+	text := func(x, y int, s string) {
+		d.Dot = fixed.P(x, y+face.Ascent)
+		d.DrawString(s)
+	}
+
+	text(chartPadding, chartPadding, truncateLabel(res.Poll.Name, (chartWidth-2*chartPadding)/charWidth))
+
+	if len(res.Summaries) == 0 {
+		text(chartPadding, chartPadding+chartRowHeight, "No choices")
+		return img
+	}
+
+	barX := chartPadding + charWidth*(chartLabelChars+1)
+	trackWidth := chartWidth - barX - chartPadding - charWidth*chartValueChars
+
+	for i, s := range res.Summaries {
+		y := chartPadding + chartRowHeight*(i+1)
+		barY := y + (chartRowHeight-chartBarHeight)/2
+
+		text(chartPadding, barY, truncateLabel(s.Answer, chartLabelChars))
+
+		track := image.Rect(barX, barY, barX+trackWidth, barY+chartBarHeight)
+		draw.Draw(img, track, image.NewUniform(chartTrack), image.Point{}, draw.Src)
+
+		if w := int(s.Percentage * float64(trackWidth)); w > 0 {
+			bar := image.Rect(barX, barY, barX+w, barY+chartBarHeight)
+			draw.Draw(img, bar, image.NewUniform(chartBar), image.Point{}, draw.Src)
+		}
+
+		text(barX+trackWidth+charWidth, barY, fmt.Sprintf("%d (%.1f%%)", s.Count, s.Percentage*100))
+	}
+
+	return img
+}
+
+// truncateLabel shortens s to at most max characters, marking the cut with
+// an ellipsis.
+func truncateLabel(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	if max <= 3 {
+		return string(r[:max])
+	}
+	return string(r[:max-3]) + "..."
+}
+
+// ResultsPNG renders a poll's results as a PNG bar chart.
+func (a *app) ResultsPNG(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	order, ok := parseResultOrder(r.FormValue("sort"))
+	if !ok {
+		a.writeError(w, r, 400, "sort must be votes or order")
+		return
+	}
+
+	res, err := a.PDAL.GetResults(r.Context(), pollId, order)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.ResultsPNG at=GetResults request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	if a.resultsOwnerOnly(r, res.Poll) {
+		w.WriteHeader(403)
+		w.Write([]byte("results visible to the poll owner only"))
+		return
+	}
+	if a.resultsHidden(r, res.Poll) {
+		w.WriteHeader(403)
+		w.Write([]byte("results hidden until poll closes"))
+		return
+	}
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, renderChart(res)); err != nil {
+		log.Printf("in=app.ResultsPNG at=Encode request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buffer.Bytes())
+}
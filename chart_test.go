@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"golang.org/x/image/font/basicfont"
+)
+
+func TestResultsPNG(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	if err := dal.Answer(context.Background(), p.ID, []int64{cs[0].ID}, "c:voter", ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	a.ResultsPNG(w, httptest.NewRequest("GET", "/results.png?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", ct)
+	}
+
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != chartWidth || b.Dy() != chartPadding*2+chartRowHeight*3 {
+		t.Errorf("size = %dx%d, want %dx%d", b.Dx(), b.Dy(), chartWidth, chartPadding*2+chartRowHeight*3)
+	}
+
+	// Red has every vote so its bar fills the track; Blue's track is bare.
+	barX := chartPadding + basicfont.Face7x13.Advance*(chartLabelChars+1) + 1
+	rowY := func(i int) int {
+		return chartPadding + chartRowHeight*(i+1) + chartRowHeight/2
+	}
+	if got := color.RGBAModel.Convert(img.At(barX, rowY(0))); got != chartBar {
+		t.Errorf("Red's bar = %v, want %v", got, chartBar)
+	}
+	if got := color.RGBAModel.Convert(img.At(barX, rowY(1))); got != chartTrack {
+		t.Errorf("Blue's bar = %v, want %v", got, chartTrack)
+	}
+}
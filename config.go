@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// secretKeys are substrings of setting names whose values are never shown.
+// Usernames count, since ADMIN_USER is half the admin credentials.
+var secretKeys = []string{"PASS", "SECRET", "TOKEN", "KEY", "USER"}
+
+// dsnPassword matches the password in a libpq key=value connection string,
+// quoted or not, or in a URL's query string.
+var dsnPassword = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s&]+)`)
+
+// redactSetting hides the value of secret settings. Values that are URLs or
+// key=value connection strings keep everything but their password.
+func redactSetting(name, value string) string {
+	if value == "" {
+		return value
+	}
+
+	upper := strings.ToUpper(name)
+	for _, s := range secretKeys {
+		if strings.Contains(upper, s) {
+			return redacted
+		}
+	}
+
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			return u.String()
+		}
+	}
+
+	return dsnPassword.ReplaceAllString(value, "${1}"+redacted)
+}
+
+// DebugConfig reports the effective configuration with secrets redacted.
+func (a *app) DebugConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	settings := make(map[string]string, len(a.Config))
+	for name, value := range a.Config {
+		settings[name] = redactSetting(name, value)
+	}
+
+	a.writeJSON(w, r, 200, settings)
+}
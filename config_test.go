@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedactSetting(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"ADMIN_USER", "alice", redacted},
+		{"ADMIN_PASS", "hunter2", redacted},
+		{"VOTER_COOKIE_SECRET", "s3cret", redacted},
+		{"TIMEZONE", "UTC", "UTC"},
+		{"DATABASE_URL", "", ""},
+		{"DATABASE_URL", "postgres://app:hunter2@db:5432/polls", "postgres://app:" + redacted + "@db:5432/polls"},
+		{"DATABASE_URL", "postgres://db/polls?password=hunter2&sslmode=require", "postgres://db/polls?password=" + redacted + "&sslmode=require"},
+		{"DATABASE_URL", "host=db user=app password=hunter2 dbname=polls", "host=db user=app password=" + redacted + " dbname=polls"},
+		{"DATABASE_URL", "host=db password = 'hunter 2' dbname=polls", "host=db password = " + redacted + " dbname=polls"},
+		{"DATABASE_URL", "host=db dbname=polls", "host=db dbname=polls"},
+	}
+
+	for _, tt := range tests {
+		if got := redactSetting(tt.name, tt.value); got != tt.want {
+			t.Errorf("redactSetting(%q, %q) = %q, want %q", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDebugConfigRequiresAdmin(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Config = map[string]string{"ADMIN_USER": "admin"}
+	handler := a.requireAdmin(a.DebugConfig)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/debug/config", nil))
+	if w.Code != 401 {
+		t.Fatalf("unauthenticated status = %d, want 401", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/debug/config", nil)
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if want := `{"ADMIN_USER":"` + redacted + `"}`; w.Body.String() != want {
+		t.Errorf("body = %s, want %s", w.Body.String(), want)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/hmac"
+	"net/http"
+)
+
+// csrfField is the form field carrying the CSRF token.
+const csrfField = "csrf_token"
+
+// csrfToken returns the CSRF token for the session identified by a voter
+// cookie token. Tokens are derived rather than stored, so only pages served
+// to the holder of the cookie can carry a valid one.
+func csrfToken(voterToken string) string {
+	return voters.mac("csrf:" + voterToken)
+}
+
+// validCSRF reports whether given is the CSRF token matching r's voter
+// cookie.
+func validCSRF(r *http.Request, given string) bool {
+	token, ok := voterToken(r)
+	if !ok {
+		return false
+	}
+
+	return given != "" && hmac.Equal([]byte(given), []byte(csrfToken(token)))
+}
+
+// csrfSafe reports whether r can be trusted without a CSRF token: it posts
+// JSON, which browsers won't send cross-site without a CORS preflight we
+// never approve, and carries a valid voter cookie.
+func csrfSafe(r *http.Request) bool {
+	_, ok := voterToken(r)
+	return ok && isJSON(r)
+}
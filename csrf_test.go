@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAnswerCSRF(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	_, otherCSRF := voterCookieFor(t)
+
+	formVote := func(cookie *http.Cookie, token string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"poll_id":   {strconv.FormatInt(p.ID, 10)},
+			"choice_id": {strconv.FormatInt(cs[0].ID, 10)},
+		}
+		if token != "" {
+			form.Set(csrfField, token)
+		}
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		a.Answer(w, r)
+		return w
+	}
+
+	cookie, csrf := voterCookieFor(t)
+	for name, token := range map[string]string{
+		"absent":          "",
+		"forged":          "bogus",
+		"another voter's": otherCSRF,
+	} {
+		if w := formVote(cookie, token); w.Code != 403 {
+			t.Errorf("%s token status = %d, want 403", name, w.Code)
+		}
+	}
+	if w := formVote(cookie, csrf); w.Code != 302 {
+		t.Errorf("valid token status = %d, want 302; body %q", w.Code, w.Body.String())
+	}
+
+	jsonVote := func(cookie *http.Cookie, contentType string) *httptest.ResponseRecorder {
+		body := `{"poll_id": "` + strconv.FormatInt(p.ID, 10) + `", "choice_id": "` + strconv.FormatInt(cs[1].ID, 10) + `"}`
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		a.Answer(w, r)
+		return w
+	}
+
+	// JSON needs no token, but still a voter cookie.
+	if w := jsonVote(nil, "application/json"); w.Code != 403 {
+		t.Errorf("JSON vote without cookie status = %d, want 403", w.Code)
+	}
+	jsonCookie, _ := voterCookieFor(t)
+	if w := jsonVote(jsonCookie, "text/plain"); w.Code != 403 {
+		t.Errorf("text/plain vote without token status = %d, want 403", w.Code)
+	}
+	if w := jsonVote(jsonCookie, "application/json"); w.Code != 201 {
+		t.Errorf("JSON vote without token status = %d, want 201; body %q", w.Code, w.Body.String())
+	}
+
+	if p, _ := dal.GetByID(context.Background(), p.ID); p.VoteCount != 2 {
+		t.Errorf("vote_count = %d, want 2", p.VoteCount)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// dialect captures the SQL differences between database backends so the
+// queries in pollDAL can be written once and shared between them.
+//
+// Postgres is the only backend, and the only one the queries run on: they
+// go on to use interval arithmetic, extract and to_timestamp, FILTER,
+// ::timestamptz casts, AT TIME ZONE, IS DISTINCT FROM, ON CONFLICT upserts,
+// UPDATE ... FROM, FOR UPDATE and, in runMigrations, pg_advisory_xact_lock,
+// none of which go through here. dialect only covers placeholders, the
+// current time and RETURNING; a second backend would need methods for the
+// rest first.
+type dialect interface {
+	// Rebind rewrites the ? placeholders in query into the backend's bind
+	// parameter syntax.
+	Rebind(query string) string
+
+	// Now returns the expression for the current timestamp.
+	Now() string
+
+	// Returning returns the clause appended to an INSERT so that it yields
+	// column for the inserted row.
+	Returning(column string) string
+}
+
+type postgresDialect struct{}
+
+// Rebind numbers placeholders $1, $2, ... in order of appearance. Question
+// marks inside quoted literals or identifiers are left alone.
+func (postgresDialect) Rebind(query string) string {
+	var buf bytes.Buffer
+	var quote rune
+	n := 0
+
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			buf.WriteByte('$')
+			buf.WriteString(strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+
+	return buf.String()
+}
+
+func (postgresDialect) Now() string {
+	return "NOW()"
+}
+
+func (postgresDialect) Returning(column string) string {
+	return " RETURNING " + column
+}
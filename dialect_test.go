@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPostgresRebind(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{`SELECT 1`, `SELECT 1`},
+		{`SELECT * FROM polls WHERE id = ?`, `SELECT * FROM polls WHERE id = $1`},
+		{`UPDATE polls SET name = ? WHERE id = ?`, `UPDATE polls SET name = $1 WHERE id = $2`},
+		{`SELECT '?' FROM polls WHERE id = ?`, `SELECT '?' FROM polls WHERE id = $1`},
+		{`SELECT "what?" FROM polls WHERE id = ?`, `SELECT "what?" FROM polls WHERE id = $1`},
+		{`SELECT 'it''s?', ?`, `SELECT 'it''s?', $1`},
+	}
+
+	for _, tt := range tests {
+		if got := (postgresDialect{}).Rebind(tt.query); got != tt.want {
+			t.Errorf("Rebind(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestPostgresNowAndReturning(t *testing.T) {
+	d := postgresDialect{}
+	if got := d.Now(); got != "NOW()" {
+		t.Errorf("Now() = %q, want NOW()", got)
+	}
+	if got := d.Returning("id, name"); got != " RETURNING id, name" {
+		t.Errorf("Returning = %q, want \" RETURNING id, name\"", got)
+	}
+}
+
+// recordedStatement is a statement run through the recording driver, with
+// the number of arguments it was run with.
+type recordedStatement struct {
+	query string
+	args  int
+}
+
+// recordingDriver is a database/sql driver that records the statements run
+// against it instead of running them. Polls can be looked up and come back
+// as an open, cached poll, and exist when counted; every other query
+// returns no rows, and every other statement reports affecting one row
+// unless affected says otherwise.
+type recordingDriver struct {
+	mu         sync.Mutex
+	statements []recordedStatement
+	affected   *int64
+}
+
+// setAffected makes statements report affecting n rows, until reset with
+// a nil n.
+func (d *recordingDriver) setAffected(n *int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.affected = n
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{d}, nil
+}
+
+func (d *recordingDriver) record(query string, args int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.statements = append(d.statements, recordedStatement{query, args})
+}
+
+// take returns the statements recorded since it was last called.
+func (d *recordingDriver) take() []recordedStatement {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	taken := d.statements
+	d.statements = nil
+	return taken
+}
+
+type recordingConn struct {
+	d *recordingDriver
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("recordingConn: Prepare not supported")
+}
+
+func (c *recordingConn) Close() error { return nil }
+
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+
+func (c *recordingConn) Commit() error { return nil }
+
+func (c *recordingConn) Rollback() error { return nil }
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.record(query, len(args))
+
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if c.d.affected != nil {
+		return driver.RowsAffected(*c.d.affected), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.record(query, len(args))
+
+	if strings.HasPrefix(query, "SELECT "+pollColumns+" FROM polls") {
+		row := []driver.Value{int64(1), "Lunch?", true, false, int64(0), true, "default", time.Now(), int64(1), false, false, "admin", nil, "public", int64(0)}
+		return &recordingRows{columns: strings.Split(pollColumns, ", "), rows: [][]driver.Value{row}}, nil
+	}
+	if strings.HasPrefix(query, "SELECT count(*) FROM polls WHERE id = ") {
+		return &recordingRows{columns: []string{"count"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}
+	return &recordingRows{}, nil
+}
+
+type recordingRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *recordingRows) Columns() []string { return r.columns }
+
+func (r *recordingRows) Close() error { return nil }
+
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var recorder = &recordingDriver{}
+
+func init() {
+	sql.Register("recorder", recorder)
+}
+
+var (
+	placeholder  = regexp.MustCompile(`\$(\d+)`)
+	quotedString = regexp.MustCompile(`'[^']*'|"[^"]*"`)
+)
+
+// checkPostgresStatement checks that stmt uses numbered placeholders, one
+// for each of its arguments, and no ? placeholders.
+func checkPostgresStatement(t *testing.T, method string, stmt recordedStatement) {
+	t.Helper()
+
+	unquoted := quotedString.ReplaceAllString(stmt.query, "")
+	if strings.Contains(unquoted, "?") {
+		t.Errorf("%s: unbound ? in %q", method, stmt.query)
+	}
+
+	seen := make(map[int]bool)
+	for _, m := range placeholder.FindAllStringSubmatch(unquoted, -1) {
+		n, _ := strconv.Atoi(m[1])
+		seen[n] = true
+	}
+	for n := 1; n <= len(seen); n++ {
+		if !seen[n] {
+			t.Errorf("%s: placeholders skip $%d in %q", method, n, stmt.query)
+		}
+	}
+	if len(seen) != stmt.args {
+		t.Errorf("%s: %d placeholders but %d args in %q", method, len(seen), stmt.args, stmt.query)
+	}
+}
+
+// TestPollDALPostgresSQL runs every pollDAL method against the recording
+// driver and checks the SQL each generates under the Postgres dialect.
+func TestPollDALPostgresSQL(t *testing.T) {
+	db, err := sql.Open("recorder", "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	dal := newPollDAL(db, postgresDialect{}, "UTC", 1000, time.Second)
+	ctx := context.Background()
+	since := time.Now().Add(-time.Hour)
+
+	methods := []struct {
+		name string
+		call func()
+	}{
+		{"GetByID", func() { dal.GetByID(ctx, 1) }},
+		{"GetLatest", func() { dal.GetLatest(ctx) }},
+		{"GetMostRecent", func() { dal.GetMostRecent(ctx) }},
+		{"GetChoices", func() { dal.GetChoices(ctx, 1) }},
+		{"GetResults", func() { dal.GetResults(ctx, 1, byVotes) }},
+		{"Answer", func() { dal.Answer(ctx, 1, []int64{2}, "c:voter", "") }},
+		{"GetVotesByHourOfDay", func() { dal.GetVotesByHourOfDay(ctx, 1) }},
+		{"GetResultsDelta", func() { dal.GetResultsDelta(ctx, 1, since) }},
+		{"RecordImpressions", func() { dal.RecordImpressions(ctx, map[int64]int64{2: 3}) }},
+		{"GetCTR", func() { dal.GetCTR(ctx, 1) }},
+		{"GetEvents", func() { dal.GetEvents(ctx, 10, 0) }},
+		{"ListPolls", func() { dal.ListPolls(ctx, 10, 0) }},
+		{"ListPollsByOwner", func() { dal.ListPollsByOwner(ctx, "admin", 10, 0) }},
+		{"ReconcileVoteCounts", func() { dal.ReconcileVoteCounts(ctx) }},
+		{"CloseAllPolls", func() { dal.CloseAllPolls(ctx) }},
+		{"CloseExpiredPolls", func() { dal.CloseExpiredPolls(ctx) }},
+		{"GetEmptyPolls", func() { dal.GetEmptyPolls(ctx, time.Hour) }},
+		{"AnswerByText", func() { dal.AnswerByText(ctx, 1, "Pizza", "c:voter", "") }},
+		{"PausePoll", func() { dal.PausePoll(ctx, 1) }},
+		{"ResumePoll", func() { dal.ResumePoll(ctx, 1) }},
+		{"GetResultsByRegion", func() { dal.GetResultsByRegion(ctx, 1) }},
+		{"GetMarginTimeline", func() { dal.GetMarginTimeline(ctx, 1, time.Hour) }},
+		{"GetVoteTimeline", func() { dal.GetVoteTimeline(ctx, 1, time.Hour) }},
+		{"GetAnswerTimestamps", func() { dal.GetAnswerTimestamps(ctx, 1) }},
+		{"GetBallots", func() { dal.GetBallots(ctx, 1) }},
+		{"GetVoterChoices", func() { dal.GetVoterChoices(ctx, 1, "c:voter") }},
+		{"PurgeOrphanAnswers", func() { dal.PurgeOrphanAnswers(ctx) }},
+		{"RefreshResultCache", func() { dal.RefreshResultCache(ctx, 1) }},
+		{"RefreshResultCaches", func() { dal.RefreshResultCaches(ctx) }},
+		{"CreatePoll", func() { dal.CreatePoll(ctx, "Lunch?", []string{"Pizza", "Tacos"}, 1, "admin") }},
+		{"PollNameTaken", func() { dal.PollNameTaken(ctx, "Lunch?") }},
+		{"SetOpen", func() { dal.SetOpen(ctx, 1, false) }},
+		{"DeletePoll", func() { dal.DeletePoll(ctx, 1) }},
+		{"RenamePoll", func() { dal.RenamePoll(ctx, 1, "Dinner?") }},
+		{"UpdateChoice", func() { dal.UpdateChoice(ctx, 2, "Sushi") }},
+		{"AddChoice", func() { dal.AddChoice(ctx, 1, "Sushi") }},
+	}
+
+	recorder.take()
+	for _, m := range methods {
+		m.call()
+
+		statements := recorder.take()
+		if len(statements) == 0 {
+			t.Errorf("%s ran no SQL", m.name)
+		}
+		for _, stmt := range statements {
+			checkPostgresStatement(t, m.name, stmt)
+		}
+	}
+}
+
+func TestPollDALPostgresSQLShape(t *testing.T) {
+	db, err := sql.Open("recorder", "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	dal := newPollDAL(db, postgresDialect{}, "UTC", 1000, time.Second)
+	ctx := context.Background()
+
+	recorder.take()
+	dal.GetByID(ctx, 1)
+	if got, want := recorder.take()[0].query, `SELECT `+pollColumns+` FROM polls WHERE id = $1`; got != want {
+		t.Errorf("GetByID query = %q, want %q", got, want)
+	}
+
+	// Voters are counted by ballot, anonymous or not, both live and when
+	// caching results.
+	dal.GetResults(ctx, 1, byVotes)
+	dal.RefreshResultCache(ctx, 1)
+	for _, stmt := range recorder.take() {
+		if strings.Contains(stmt.query, "voter") && !strings.Contains(stmt.query, "FROM ballots") {
+			t.Errorf("voters counted without ballots: %q", stmt.query)
+		}
+	}
+
+	dal.AddChoice(ctx, 1, "Sushi")
+	stmts := recorder.take()
+	if !strings.Contains(stmts[0].query, "NOW()") || !strings.HasSuffix(stmts[0].query, " RETURNING id, poll_id, answer, category, created_at") {
+		t.Errorf("AddChoice query = %q, want NOW() and a RETURNING clause", stmts[0].query)
+	}
+}
+
+func TestSetOpenAlreadyClosedSQL(t *testing.T) {
+	db, err := sql.Open("recorder", "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	dal := newPollDAL(db, postgresDialect{}, "UTC", 1000, time.Second)
+
+	// The UPDATE matches no row as the poll is already closed, but it
+	// exists, so closing it again is a no-op.
+	recorder.take()
+	if err := dal.SetOpen(context.Background(), 1, false); err != nil {
+		t.Fatalf("SetOpen: %v", err)
+	}
+	for _, stmt := range recorder.take() {
+		if strings.Contains(stmt.query, "INSERT INTO events") || strings.Contains(stmt.query, "poll_result_cache") {
+			t.Errorf("no-op close ran %q", stmt.query)
+		}
+	}
+}
+
+// TestCloseAtBoundarySQL checks the SQL agrees with the in-memory DAL on
+// close_at: votes are taken strictly before it, and a poll is expired from
+// it on, so exactly at close_at it's closed both ways.
+func TestCloseAtBoundarySQL(t *testing.T) {
+	db, err := sql.Open("recorder", "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	dal := newPollDAL(db, postgresDialect{}, "UTC", 1000, time.Second)
+	ctx := context.Background()
+
+	recorder.take()
+	dal.Answer(ctx, 1, []int64{2}, "c:voter", "")
+	stmts := recorder.take()
+	if len(stmts) == 0 || !strings.Contains(stmts[0].query, "(close_at IS NULL OR close_at > NOW())") {
+		t.Errorf("Answer state query = %v, want votes only before close_at", stmts)
+	}
+
+	dal.CloseExpiredPolls(ctx)
+	stmts = recorder.take()
+	if len(stmts) == 0 || !strings.Contains(stmts[0].query, "close_at <= NOW()") {
+		t.Errorf("CloseExpiredPolls query = %v, want polls expired from close_at on", stmts)
+	}
+}
+
+func TestGetResultsTieBreakSQL(t *testing.T) {
+	db, err := sql.Open("recorder", "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	dal := newPollDAL(db, postgresDialect{}, "UTC", 1000, time.Second)
+
+	recorder.take()
+	dal.GetResults(context.Background(), 1, byVotes)
+	var ordered bool
+	for _, stmt := range recorder.take() {
+		if strings.Contains(stmt.query, "FROM choices") && strings.Contains(stmt.query, "ORDER BY") {
+			ordered = true
+			if !strings.HasSuffix(stmt.query, "DESC, c.id ASC") {
+				t.Errorf("GetResults query = %q, want ties broken by c.id", stmt.query)
+			}
+		}
+	}
+	if !ordered {
+		t.Error("GetResults ran no ordered query over choices")
+	}
+}
+
+func TestCloseAllPollsSQL(t *testing.T) {
+	db, err := sql.Open("recorder", "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	dal := newPollDAL(db, postgresDialect{}, "UTC", 1000, time.Second)
+
+	recorder.take()
+	dal.CloseAllPolls(context.Background())
+	var updates []string
+	for _, stmt := range recorder.take() {
+		if strings.HasPrefix(stmt.query, "UPDATE ") {
+			updates = append(updates, stmt.query)
+		}
+	}
+	if len(updates) != 1 || updates[0] != "UPDATE polls SET is_open = false WHERE is_open = true" {
+		t.Errorf("CloseAllPolls updates = %q, want one UPDATE of the open polls", updates)
+	}
+}
+
+func TestDeletePollSQLOrder(t *testing.T) {
+	db, err := sql.Open("recorder", "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	dal := newPollDAL(db, postgresDialect{}, "UTC", 1000, time.Second)
+
+	recorder.take()
+	if err := dal.DeletePoll(context.Background(), 1); err != nil {
+		t.Fatalf("DeletePoll: %v", err)
+	}
+
+	// Everything referring to a choice or the poll goes before them.
+	var tables []string
+	for _, stmt := range recorder.take() {
+		if strings.HasPrefix(stmt.query, "DELETE FROM ") {
+			tables = append(tables, strings.Fields(stmt.query)[2])
+		}
+	}
+	if got, want := strings.Join(tables, " "), "answers impressions poll_result_cache poll_snapshots ballots choices polls"; got != want {
+		t.Errorf("DeletePoll deletes from %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+// geolocator resolves a client IP address to an approximate region, such
+// as a country or state code, for per-region results.
+type geolocator interface {
+	Region(ip string) string
+}
+
+// noopGeolocator is the default geolocator. It knows no regions, so votes
+// are recorded without one.
+type noopGeolocator struct{}
+
+func (noopGeolocator) Region(ip string) string {
+	return ""
+}
+
+// regionResult is the vote distribution among voters from one region.
+type regionResult struct {
+	Region    string     `json:"region"`
+	Summaries []*summary `json:"summaries"`
+	Count     int64      `json:"count"`
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// healthTimeout bounds how long Health waits on the database.
+const healthTimeout = 2 * time.Second
+
+// Health reports whether the database is reachable, for load balancer
+// readiness checks.
+func (a *app) Health(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+
+	// Not every driver honors the context on a wedged connection, so don't
+	// wait on the ping past the deadline either.
+	pinged := make(chan error, 1)
+	go func() { pinged <- a.PDAL.Ping(ctx) }()
+
+	var err error
+	select {
+	case err = <-pinged:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		log.Printf("in=app.Health at=Ping request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeJSON(w, r, 503, map[string]string{"status": "unavailable"})
+		return
+	}
+
+	a.writeJSON(w, r, 200, map[string]string{"status": "ok"})
+}
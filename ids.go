@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errBadChecksum = errors.New("id checksum mismatch")
+
+// idChecksumLen is the number of hex characters of HMAC kept in an id.
+const idChecksumLen = 8
+
+// idCodec adds a short HMAC checksum to the ids we put in forms and URLs,
+// e.g. "42-1a2b3c4d", so tampered or mistyped ids are rejected rather than
+// silently pointing at another poll. The checksum covers the kind of id,
+// so a choice id can't be passed off as a poll id. Without a key ids are
+// plain integers, so main always gives ids one.
+type idCodec struct {
+	key []byte
+}
+
+// ids is the codec used by handlers and templates, keyed from
+// ID_SIGNING_KEY at startup, or randomly when that's unset.
+var ids = &idCodec{}
+
+func (c *idCodec) Encode(kind string, id int64) string {
+	s := strconv.FormatInt(id, 10)
+	if len(c.key) == 0 {
+		return s
+	}
+	return s + "-" + c.checksum(kind, s)
+}
+
+func (c *idCodec) Decode(kind, s string) (int64, error) {
+	if len(c.key) == 0 {
+		return strconv.ParseInt(s, 10, 64)
+	}
+
+	i := strings.LastIndex(s, "-")
+	if i < 0 {
+		return 0, errBadChecksum
+	}
+
+	raw, sum := s[:i], s[i+1:]
+	if !hmac.Equal([]byte(sum), []byte(c.checksum(kind, raw))) {
+		return 0, errBadChecksum
+	}
+
+	return strconv.ParseInt(raw, 10, 64)
+}
+
+func (c *idCodec) checksum(kind, id string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(kind + ":" + id))
+	return hex.EncodeToString(mac.Sum(nil))[:idChecksumLen]
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIDCodecRoundTrip(t *testing.T) {
+	c := &idCodec{key: []byte("test signing key")}
+
+	s := c.Encode("poll", 42)
+	if !strings.HasPrefix(s, "42-") {
+		t.Fatalf("Encode = %q, want 42 and a checksum", s)
+	}
+	if id, err := c.Decode("poll", s); err != nil || id != 42 {
+		t.Errorf("Decode(%q) = %d, %v; want 42", s, id, err)
+	}
+}
+
+func TestIDCodecRejectsTampering(t *testing.T) {
+	c := &idCodec{key: []byte("test signing key")}
+	s := c.Encode("poll", 42)
+	sum := s[strings.LastIndex(s, "-"):]
+
+	for _, bad := range []string{
+		"43" + sum,         // id changed, checksum kept
+		"42",               // checksum dropped
+		"42-00000000",      // checksum made up
+		s[:len(s)-1] + "x", // checksum altered
+	} {
+		if _, err := c.Decode("poll", bad); err != errBadChecksum {
+			t.Errorf("Decode(%q) err = %v, want errBadChecksum", bad, err)
+		}
+	}
+
+	other := &idCodec{key: []byte("another key")}
+	if _, err := other.Decode("poll", s); err != errBadChecksum {
+		t.Errorf("Decode under another key err = %v, want errBadChecksum", err)
+	}
+}
+
+func TestIDCodecRejectsWrongKind(t *testing.T) {
+	c := &idCodec{key: []byte("test signing key")}
+
+	s := c.Encode("choice", 42)
+	if _, err := c.Decode("poll", s); err != errBadChecksum {
+		t.Errorf("choice id decoded as a poll id: err = %v, want errBadChecksum", err)
+	}
+}
+
+func TestTamperedPollIDIsBadRequest(t *testing.T) {
+	ids.key = []byte("test signing key")
+	defer func() { ids.key = nil }()
+
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+
+	for _, pollID := range []string{
+		strconv.FormatInt(p.ID, 10),
+		ids.Encode("choice", cs[0].ID),
+		ids.Encode("poll", p.ID+1)[:1] + ids.Encode("poll", p.ID)[1:],
+	} {
+		w := httptest.NewRecorder()
+		a.Results(w, httptest.NewRequest("GET", "/results?poll_id="+pollID, nil))
+		if w.Code != 400 {
+			t.Errorf("poll_id %q: status = %d, want 400", pollID, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/results?poll_id="+ids.Encode("poll", p.ID), nil))
+	if w.Code != 200 {
+		t.Errorf("signed poll_id: status = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// impressionLogger counts how often choices are shown without slowing down
+// page rendering. Impressions are queued on a buffered channel, aggregated
+// in memory and flushed to the database in batches. When the queue is full
+// impressions are dropped rather than blocking the request.
+type impressionLogger struct {
+	dal      pollDALer
+	queue    chan int64
+	interval time.Duration
+}
+
+func newImpressionLogger(dal pollDALer, buffer int, interval time.Duration) *impressionLogger {
+	return &impressionLogger{
+		dal:      dal,
+		queue:    make(chan int64, buffer),
+		interval: interval,
+	}
+}
+
+// Record queues an impression for each choice, dropping any that don't fit.
+func (l *impressionLogger) Record(choices []*choice) {
+	for _, c := range choices {
+		select {
+		case l.queue <- c.ID:
+		default:
+			return
+		}
+	}
+}
+
+// Run aggregates queued impressions and flushes them every interval. It
+// never returns.
+func (l *impressionLogger) Run() {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	counts := make(map[int64]int64)
+	for {
+		select {
+		case id := <-l.queue:
+			counts[id]++
+		case <-ticker.C:
+			if len(counts) == 0 {
+				continue
+			}
+			if err := l.dal.RecordImpressions(context.Background(), counts); err != nil {
+				log.Printf("in=impressionLogger.Run at=RecordImpressions count=%d err=%q", len(counts), err)
+			}
+			counts = make(map[int64]int64)
+		}
+	}
+}
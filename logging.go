@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = 200
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// logRequests returns middleware logging the method, path, status and
+// duration of requests. level "errors" only logs responses with a 4xx or
+// 5xx status, "off" logs nothing and anything else logs every request.
+// When m is non-nil every request is also measured, labelled with the
+// pattern mux routes it to.
+func logRequests(level string, mux *http.ServeMux, m *metrics) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+
+			if rec.status == 0 {
+				rec.status = 200
+			}
+			elapsed := time.Since(start)
+
+			if m != nil {
+				_, pattern := mux.Handler(r)
+				m.Observe(pattern, rec.status, elapsed)
+			}
+
+			if level == "off" || (level == "errors" && rec.status < 400) {
+				return
+			}
+
+			log.Printf("in=http at=request request_id=%s method=%s path=%q status=%d duration=%s",
+				requestID(r.Context()), r.Method, r.URL.Path, rec.status, elapsed)
+		})
+	}
+}
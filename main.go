@@ -2,408 +2,4018 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"database/sql"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-const maxIdleConns = 1
-const maxOpenConns = 15
+const defaultMaxIdleConns = 1
+const defaultMaxOpenConns = 15
+
+// version is set at build time with -ldflags "-X main.version=<version>".
+var version = "dev"
 
 var notFound = errors.New("not found")
+var errConstraint = errors.New("constraint violation")
+var errUnexpectedRows = errors.New("unexpected number of rows affected")
+var errNoMatchingChoice = errors.New("no choice matches answer")
+var errAmbiguousChoice = errors.New("answer matches more than one choice")
+var errTooManyChoices = errors.New("poll has too many choices")
+var errPaused = errors.New("voting paused")
+var errClosed = errors.New("poll closed")
+var errAlreadyVoted = errors.New("already voted")
+var errChoiceMismatch = errors.New("choice belongs to another poll")
+var errSelectionCount = errors.New("wrong number of choices selected")
 
 type poll struct {
-	ID        int64
-	Name      string
-	IsOpen    bool
-	CreatedAt time.Time
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	IsOpen    bool   `json:"is_open"`
+	Paused    bool   `json:"paused"`
+	VoteCount int64  `json:"vote_count"`
+
+	// CacheResults marks very large polls whose results are read from
+	// poll_result_cache rather than aggregated on every request.
+	CacheResults bool `json:"cache_results"`
+
+	Theme     string    `json:"theme"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// MaxSelections is how many choices a voter may pick, one for a
+	// regular poll.
+	MaxSelections int `json:"max_selections"`
+
+	// ResultsHidden keeps the tallies from everyone but admins until the
+	// poll closes. It predates ResultsVisibility and acts like its
+	// after_close.
+	ResultsHidden bool `json:"results_hidden"`
+
+	// ShuffleChoices lists the choices in a random order on every page
+	// load, to counter voters' bias towards the first one.
+	ShuffleChoices bool `json:"shuffle_choices"`
+
+	// Owner is the admin user who created the poll, empty for polls
+	// created before owners were recorded.
+	Owner string `json:"owner"`
+
+	// CloseAt, when set, is when the poll stops accepting votes, whether
+	// or not it has been closed yet.
+	CloseAt *time.Time `json:"close_at"`
+
+	// ResultsVisibility is who may see the tallies: everyone when
+	// visibilityPublic, only the owner when visibilityOwner, and everyone
+	// but only once the poll closes when visibilityAfterClose.
+	ResultsVisibility string `json:"results_visibility"`
+
+	// VoteChangeWindow is how many seconds after voting a voter may vote
+	// again to replace their vote. Zero means votes are final.
+	VoteChangeWindow int `json:"vote_change_window"`
+}
+
+// Values of poll.ResultsVisibility.
+const (
+	visibilityPublic     = "public"
+	visibilityOwner      = "owner"
+	visibilityAfterClose = "after_close"
+)
+
+// MarshalJSON writes p's id as ids encodes it, so API clients can pass it
+// straight back.
+func (p *poll) MarshalJSON() ([]byte, error) {
+	type plain poll
+	return json.Marshal(struct {
+		*plain
+		ID string `json:"id"`
+	}{(*plain)(p), ids.Encode("poll", p.ID)})
 }
 
 type choice struct {
-	ID        int64
-	PollID    int64
-	Answer    string
-	CreatedAt time.Time
+	ID        int64     `json:"id"`
+	PollID    int64     `json:"poll_id"`
+	Answer    string    `json:"answer"`
+	Category  string    `json:"category"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MarshalJSON writes c's ids as ids encodes them, so API clients can vote
+// with them.
+func (c *choice) MarshalJSON() ([]byte, error) {
+	type plain choice
+	return json.Marshal(struct {
+		*plain
+		ID     string `json:"id"`
+		PollID string `json:"poll_id"`
+	}{(*plain)(c), ids.Encode("choice", c.ID), ids.Encode("poll", c.PollID)})
 }
 
 type summary struct {
 	choice
+	Count      int64   `json:"count"`
+	Percentage float64 `json:"percentage"`
+}
+
+// MarshalJSON rounds Percentage to three decimals, matching the precision
+// of the HTML and CSV results, and encodes ids like choice does.
+func (s *summary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID         string    `json:"id"`
+		PollID     string    `json:"poll_id"`
+		Answer     string    `json:"answer"`
+		Category   string    `json:"category"`
+		CreatedAt  time.Time `json:"created_at"`
+		Count      int64     `json:"count"`
+		Percentage float64   `json:"percentage"`
+	}{
+		ID:         ids.Encode("choice", s.ID),
+		PollID:     ids.Encode("poll", s.PollID),
+		Answer:     s.Answer,
+		Category:   s.Category,
+		CreatedAt:  s.CreatedAt,
+		Count:      s.Count,
+		Percentage: math.Round(s.Percentage*1000) / 1000,
+	})
+}
+
+// resultOrder is the order results list choices in.
+type resultOrder string
+
+const (
+	// byVotes lists the most voted for choices first, ties by creation.
+	byVotes resultOrder = "votes"
+	// byChoiceOrder keeps choices in the order they were created, so the
+	// layout stays put as votes come in.
+	byChoiceOrder resultOrder = "order"
+)
+
+// parseResultOrder reads the ?sort= parameter, defaulting to byVotes.
+func parseResultOrder(s string) (resultOrder, bool) {
+	switch resultOrder(s) {
+	case "", byVotes:
+		return byVotes, true
+	case byChoiceOrder:
+		return byChoiceOrder, true
+	}
+	return "", false
+}
+
+type result struct {
+	Poll       *poll       `json:"poll"`
+	Summaries  []*summary  `json:"summaries"`
+	Categories []*category `json:"categories"`
+	Count      int64       `json:"count"`
+
+	// VoterCount is how many voters cast the Count votes, fewer than Count
+	// when voters may pick several choices. Votes without a voter id count
+	// as a voter each.
+	VoterCount int64 `json:"voter_count"`
+
+	// Entropy is the Shannon entropy, in bits, of the vote distribution:
+	// 0 when unanimous, log2(n) for an even split across n choices.
+	Entropy float64 `json:"entropy"`
+}
+
+// flatRow is a single choice of a result with its poll denormalized onto
+// it, for table-oriented templates and exports.
+type flatRow struct {
+	PollID     int64
+	PollName   string
+	ChoiceID   int64
+	Answer     string
+	Category   string
 	Count      int64
 	Percentage float64
 }
 
-type result struct {
-	Poll      *poll
-	Summaries []*summary
-	Count     int64
+// Flatten returns one row per summary, in the same order as Summaries.
+func (res *result) Flatten() []flatRow {
+	rows := make([]flatRow, 0, len(res.Summaries))
+	for _, s := range res.Summaries {
+		rows = append(rows, flatRow{
+			PollID:     res.Poll.ID,
+			PollName:   res.Poll.Name,
+			ChoiceID:   s.ID,
+			Answer:     s.Answer,
+			Category:   s.Category,
+			Count:      s.Count,
+			Percentage: s.Percentage,
+		})
+	}
+	return rows
+}
+
+// category groups the summaries of choices sharing a category, with the
+// subtotal of their votes. Uncategorized choices share the "" category.
+type category struct {
+	Name      string     `json:"name"`
+	Summaries []*summary `json:"summaries"`
+	Count     int64      `json:"count"`
+}
+
+// others aggregates the summaries left out of a truncated results page.
+type others struct {
+	Choices    int
+	Count      int64
+	Percentage float64
+}
+
+// resultsView is what the results template renders: res with at most max
+// summaries, the rest collapsed into Others.
+type resultsView struct {
+	*result
+	Categories []*category
+	Others     *others
+}
+
+// newResultsView keeps the first max summaries of res, in its order, and
+// folds the remainder into a single others row. A max of zero or less keeps
+// everything.
+func newResultsView(res *result, max int) *resultsView {
+	v := &resultsView{result: res, Categories: res.Categories}
+	if max <= 0 || len(res.Summaries) <= max {
+		return v
+	}
+
+	o := &others{}
+	for _, s := range res.Summaries[max:] {
+		o.Choices++
+		o.Count += s.Count
+		o.Percentage += s.Percentage
+	}
+
+	v.Categories = groupByCategory(res.Summaries[:max])
+	v.Others = o
+	return v
+}
+
+// groupByCategory buckets summaries by category, keeping the order in which
+// each category is first seen.
+func groupByCategory(summaries []*summary) []*category {
+	var categories []*category
+	byName := make(map[string]*category)
+
+	for _, s := range summaries {
+		c, ok := byName[s.Category]
+		if !ok {
+			c = &category{Name: s.Category}
+			byName[s.Category] = c
+			categories = append(categories, c)
+		}
+		c.Summaries = append(c.Summaries, s)
+		c.Count += s.Count
+	}
+
+	return categories
+}
+
+// delta reports a choice's current vote count alongside how much it moved
+// since some point in time. RelativeChange is Change as a fraction of the
+// count before that point, and is left at zero when there was none.
+type delta struct {
+	ChoiceID       int64   `json:"choice_id"`
+	Answer         string  `json:"answer"`
+	Count          int64   `json:"count"`
+	Change         int64   `json:"change"`
+	RelativeChange float64 `json:"relative_change"`
+}
+
+func (d *delta) MarshalJSON() ([]byte, error) {
+	type plain delta
+	return json.Marshal(struct {
+		*plain
+		ChoiceID string `json:"choice_id"`
+	}{(*plain)(d), ids.Encode("choice", d.ChoiceID)})
+}
+
+// ctr is the click-through rate of a choice: how often it was voted for
+// relative to how often it was shown.
+type ctr struct {
+	ChoiceID    int64   `json:"choice_id"`
+	Answer      string  `json:"answer"`
+	Impressions int64   `json:"impressions"`
+	Votes       int64   `json:"votes"`
+	Rate        float64 `json:"rate"`
+}
+
+func (c *ctr) MarshalJSON() ([]byte, error) {
+	type plain ctr
+	return json.Marshal(struct {
+		*plain
+		ChoiceID string `json:"choice_id"`
+	}{(*plain)(c), ids.Encode("choice", c.ChoiceID)})
+}
+
+// event is an entry in the append-only log of mutations.
+type event struct {
+	ID        int64           `json:"id"`
+	Kind      string          `json:"kind"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// timelineBucket counts the votes cast during a time bucket, and in total
+// by the end of it.
+type timelineBucket struct {
+	Time  time.Time `json:"time"`
+	Count int64     `json:"count"`
+	Total int64     `json:"total"`
+}
+
+// marginPoint is the state of the race at the end of a time bucket: who was
+// leading on cumulative votes, and by how many. LeaderID is zero while the
+// lead is tied.
+type marginPoint struct {
+	Time     time.Time `json:"time"`
+	LeaderID int64     `json:"leader_id"`
+	Margin   int64     `json:"margin"`
+}
+
+// MarshalJSON encodes LeaderID like choice ids, leaving it empty while the
+// lead is tied.
+func (m *marginPoint) MarshalJSON() ([]byte, error) {
+	type plain marginPoint
+	var leader string
+	if m.LeaderID != 0 {
+		leader = ids.Encode("choice", m.LeaderID)
+	}
+	return json.Marshal(struct {
+		*plain
+		LeaderID string `json:"leader_id"`
+	}{(*plain)(m), leader})
 }
 
 type pollDALer interface {
-	GetByID(pollId int64) (*poll, error)
-	GetLatest() (*poll, error)
-	GetChoices(pollId int64) ([]*choice, error)
-	GetResults(pollId int64) (*result, error)
-	Answer(pollId, choiceId int64) error
+	GetByID(ctx context.Context, pollId int64) (*poll, error)
+	GetLatest(ctx context.Context) (*poll, error)
+	GetMostRecent(ctx context.Context) (*poll, error)
+	GetChoices(ctx context.Context, pollId int64) ([]*choice, bool, error)
+	GetResults(ctx context.Context, pollId int64, order resultOrder) (*result, error)
+	Answer(ctx context.Context, pollId int64, choiceIds []int64, voterID, region string) error
+	GetVotesByHourOfDay(ctx context.Context, pollId int64) ([24]int64, error)
+	GetResultsDelta(ctx context.Context, pollId int64, since time.Time) ([]*delta, error)
+	RecordImpressions(ctx context.Context, counts map[int64]int64) error
+	GetCTR(ctx context.Context, pollId int64) ([]*ctr, error)
+	GetEvents(ctx context.Context, limit, offset int) ([]*event, error)
+	ListPolls(ctx context.Context, limit, offset int) ([]*poll, error)
+	ListPollsByOwner(ctx context.Context, owner string, limit, offset int) ([]*poll, error)
+	ReconcileVoteCounts(ctx context.Context) (int64, error)
+	CloseAllPolls(ctx context.Context) (int64, error)
+	CloseExpiredPolls(ctx context.Context) (int64, error)
+	GetEmptyPolls(ctx context.Context, olderThan time.Duration) ([]*poll, error)
+	AnswerByText(ctx context.Context, pollId int64, answerText, voterID, region string) error
+	PausePoll(ctx context.Context, pollId int64) error
+	ResumePoll(ctx context.Context, pollId int64) error
+	GetResultsByRegion(ctx context.Context, pollId int64) ([]*regionResult, error)
+	GetMarginTimeline(ctx context.Context, pollId int64, bucket time.Duration) ([]*marginPoint, error)
+	GetVoteTimeline(ctx context.Context, pollId int64, bucket time.Duration) ([]*timelineBucket, error)
+	GetAnswerTimestamps(ctx context.Context, pollId int64) (map[int64][]time.Time, error)
+	GetBallots(ctx context.Context, pollId int64) ([]*ballot, error)
+	GetVoterChoices(ctx context.Context, pollId int64, voterID string) ([]int64, error)
+	PurgeOrphanAnswers(ctx context.Context) (int64, error)
+	RefreshResultCache(ctx context.Context, pollId int64) error
+	RefreshResultCaches(ctx context.Context) error
+	CreatePoll(ctx context.Context, name string, choices []string, maxSelections int, owner string) (*poll, error)
+	PollNameTaken(ctx context.Context, name string) (bool, error)
+	SetOpen(ctx context.Context, pollId int64, open bool) error
+	DeletePoll(ctx context.Context, pollId int64) error
+	RenamePoll(ctx context.Context, pollId int64, name string) error
+	UpdateChoice(ctx context.Context, choiceId int64, answer string) error
+	AddChoice(ctx context.Context, pollId int64, answer string) (*choice, error)
+	Ping(ctx context.Context) error
 }
 
+// pollDAL is the pollDALer backed by a Postgres database; see dialect for
+// what of its SQL is Postgres-specific.
 type pollDAL struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect dialect
+
+	// timezone is the IANA zone used when bucketing votes by time of day.
+	timezone string
+
+	// maxChoices is the most choices GetChoices will return for a poll.
+	maxChoices int
+
+	// queryTimeout bounds how long each method may spend in the database.
+	// Zero means no limit beyond the caller's context.
+	queryTimeout time.Duration
+}
+
+func newPollDAL(db *sql.DB, dialect dialect, timezone string, maxChoices int, queryTimeout time.Duration) pollDALer {
+	return &pollDAL{db: db, dialect: dialect, timezone: timezone, maxChoices: maxChoices, queryTimeout: queryTimeout}
+}
+
+// withTimeout derives a context from ctx that expires after queryTimeout.
+func (d *pollDAL) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.queryTimeout)
 }
 
-func newPollDAL(db *sql.DB) pollDALer {
-	return &pollDAL{db: db}
+// pollColumns are the columns scanPoll expects, in order.
+const pollColumns = `id, name, is_open, paused, vote_count, cache_results, theme, created_at, max_selections, results_hidden, shuffle_choices, owner, close_at, results_visibility, vote_change_window`
+
+func scanPoll(rows *sql.Rows) *poll {
+	p := &poll{}
+	rows.Scan(&(p.ID), &(p.Name), &(p.IsOpen), &(p.Paused), &(p.VoteCount), &(p.CacheResults), &(p.Theme), &(p.CreatedAt), &(p.MaxSelections), &(p.ResultsHidden), &(p.ShuffleChoices), &(p.Owner), &(p.CloseAt), &(p.ResultsVisibility), &(p.VoteChangeWindow))
+	return p
 }
 
-func (d *pollDAL) GetByID(pollId int64) (*poll, error) {
-	query := `SELECT id, name, is_open, created_at FROM polls WHERE id = $1`
+func (d *pollDAL) GetByID(ctx context.Context, pollId int64) (*poll, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	rows, err := d.db.Query(query, pollId)
+	query := d.dialect.Rebind(`SELECT ` + pollColumns + ` FROM polls WHERE id = ?`)
+
+	rows, err := d.db.QueryContext(ctx, query, pollId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	p := &poll{}
 	if rows.Next() {
-		rows.Scan(&(p.ID), &(p.Name), &(p.IsOpen), &(p.CreatedAt))
-		return p, nil
+		return scanPoll(rows), nil
 	}
 
 	return nil, notFound
 }
 
-func (d *pollDAL) GetLatest() (*poll, error) {
-	query := `SELECT id, name, is_open, created_at FROM polls WHERE is_open = true ORDER BY created_at DESC LIMIT 1`
+func (d *pollDAL) GetLatest(ctx context.Context) (*poll, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	rows, err := d.db.Query(query)
+	query := `SELECT ` + pollColumns + ` FROM polls WHERE is_open = true ORDER BY created_at DESC LIMIT 1`
+
+	rows, err := d.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	p := &poll{}
 	if rows.Next() {
-		rows.Scan(&(p.ID), &(p.Name), &(p.IsOpen), &(p.CreatedAt))
-		return p, nil
+		return scanPoll(rows), nil
 	}
 
 	return nil, notFound
 }
 
-func (d *pollDAL) GetChoices(pollId int64) ([]*choice, error) {
-	query := `SELECT id, poll_id, answer, created_at FROM choices WHERE poll_id = $1 ORDER BY id`
+// GetMostRecent returns the most recently created poll, open or not.
+func (d *pollDAL) GetMostRecent(ctx context.Context) (*poll, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	rows, err := d.db.Query(query, pollId)
+	query := `SELECT ` + pollColumns + ` FROM polls ORDER BY created_at DESC LIMIT 1`
+
+	rows, err := d.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	if rows.Next() {
+		return scanPoll(rows), nil
+	}
+
+	return nil, notFound
+}
+
+// GetChoices returns up to maxChoices of pollId's choices, and whether there
+// were more that were left out.
+func (d *pollDAL) GetChoices(ctx context.Context, pollId int64) ([]*choice, bool, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT id, poll_id, answer, category, created_at FROM choices WHERE poll_id = ? ORDER BY id LIMIT ?`)
+
+	// Fetch one past the cap so we can tell it was exceeded without
+	// loading a pathological poll into memory.
+	rows, err := d.db.QueryContext(ctx, query, pollId, d.maxChoices+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
 	var choices []*choice
 
 	for rows.Next() {
 		c := &choice{}
-		rows.Scan(&(c.ID), &(c.PollID), &(c.Answer), &(c.CreatedAt))
+		rows.Scan(&(c.ID), &(c.PollID), &(c.Answer), &(c.Category), &(c.CreatedAt))
 		choices = append(choices, c)
 	}
 
-	return choices, nil
+	if len(choices) > d.maxChoices {
+		return choices[:d.maxChoices], true, nil
+	}
+
+	return choices, false, nil
 }
 
-func (d *pollDAL) GetResults(pollId int64) (*result, error) {
-	query := `SELECT c.id, c.poll_id, c.answer, c.created_at, count(a.choice_id) FROM choices c
-LEFT OUTER JOIN answers a ON a.choice_id = c.id
-WHERE c.poll_id = $1
-GROUP BY c.id, c.poll_id, c.answer, c.created_at, a.choice_id
-ORDER BY count(a.choice_id) DESC`
+// GetResults tallies a poll's votes, listing its choices in the given
+// order. Polls flagged with cache_results are read from poll_result_cache,
+// falling back to live aggregation until the cache has first been
+// refreshed.
+func (d *pollDAL) GetResults(ctx context.Context, pollId int64, order resultOrder) (*result, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	result := &result{}
+	query := d.dialect.Rebind(`SELECT c.id, c.poll_id, c.answer, c.category, c.created_at, count(a.choice_id) FROM choices c
+LEFT OUTER JOIN answers a ON a.choice_id = c.id
+WHERE c.poll_id = ?
+GROUP BY c.id, c.poll_id, c.answer, c.category, c.created_at
+ORDER BY count(a.choice_id) DESC, c.id ASC`)
+	cachedQuery := d.dialect.Rebind(`SELECT c.id, c.poll_id, c.answer, c.category, c.created_at, rc.count FROM poll_result_cache rc
+JOIN choices c ON c.id = rc.choice_id
+WHERE rc.poll_id = ?
+ORDER BY rc.count DESC, c.id ASC`)
+	// A ballot is one vote, however many choices it selects.
+	votersQuery := d.dialect.Rebind(`SELECT count(*) FROM ballots WHERE poll_id = ?`)
+	cachedVotersQuery := d.dialect.Rebind(`SELECT voter_count FROM poll_result_cache WHERE poll_id = ? LIMIT 1`)
+	snapshotQuery := d.dialect.Rebind(`SELECT result FROM poll_snapshots WHERE poll_id = ?`)
 
 	// get the poll
-	p, err := d.GetByID(pollId)
+	p, err := d.GetByID(ctx, pollId)
 	if err != nil {
 		return nil, err
 	}
 
-	result.Poll = p
-
-	rows, err := d.db.Query(query, pollId)
-	if err != nil {
-		return nil, err
+	// Closed polls read back the result they closed with.
+	if !p.IsOpen {
+		var raw []byte
+		err := d.db.QueryRowContext(ctx, snapshotQuery, pollId).Scan(&raw)
+		if err == nil {
+			return decodeSnapshot(ctx, p, raw, order)
+		} else if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("reading snapshot of poll %d: %w", pollId, err)
+		}
 	}
-	defer rows.Close()
 
 	var summaries []*summary
+	if p.CacheResults {
+		summaries, err = d.querySummaries(ctx, cachedQuery, pollId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(summaries) == 0 {
+		summaries, err = d.querySummaries(ctx, query, pollId)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Cached results count voters as of the same refresh.
+		votersQuery = cachedVotersQuery
+	}
+
+	// Both queries order by votes.
+	if order == byChoiceOrder {
+		sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].ID < summaries[j].ID })
+	}
+
+	res := newResult(ctx, p, summaries)
+	if err := d.db.QueryRowContext(ctx, votersQuery, pollId).Scan(&res.VoterCount); err != nil {
+		return nil, fmt.Errorf("counting voters of poll %d: %w", pollId, err)
+	}
+
+	return res, nil
+}
+
+// newResult totals the votes of p's summaries and fills in their
+// percentages, categories and entropy.
+func newResult(ctx context.Context, p *poll, summaries []*summary) *result {
 	var totalVotes int64
 
-	for rows.Next() {
-		s := &summary{}
-		rows.Scan(&(s.ID), &(s.PollID), &(s.Answer), &(s.CreatedAt), &(s.Count))
-		summaries = append(summaries, s)
-		totalVotes += s.Count
+	for _, s := range summaries {
+		var ok bool
+		if totalVotes, ok = addVotes(totalVotes, s.Count); !ok {
+			log.Printf("in=pollDAL.GetResults at=overflow request_id=%s poll_id=%d", requestID(ctx), p.ID)
+		}
+	}
+
+	if totalVotes > maxExactVotes {
+		log.Printf("in=pollDAL.GetResults at=implausible request_id=%s poll_id=%d total=%d", requestID(ctx), p.ID, totalVotes)
 	}
 
 	if totalVotes > 0 {
 		// compute percentages
 		for i, s := range summaries {
-			summaries[i].Percentage = float64(s.Count) / float64(totalVotes)
+			summaries[i].Percentage = percentage(s.Count, totalVotes)
 		}
 	}
-	result.Summaries = summaries
-	result.Count = totalVotes
 
-	return result, nil
+	counts := make([]int64, len(summaries))
+	for i, s := range summaries {
+		counts[i] = s.Count
+	}
+
+	return &result{
+		Poll:       p,
+		Summaries:  summaries,
+		Categories: groupByCategory(summaries),
+		Count:      totalVotes,
+		Entropy:    entropy(counts),
+	}
 }
 
-func (d *pollDAL) Answer(pollId, choiceId int64) error {
-	query := `INSERT INTO answers (choice_id, created_at)
-SELECT id, NOW() FROM choices WHERE poll_id = $1 AND id = $2`
+// CreatePoll inserts an open poll with the given choices. Everything is
+// written in one transaction so a poll never exists without its choices.
+func (d *pollDAL) CreatePoll(ctx context.Context, name string, choices []string, maxSelections int, owner string) (*poll, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	pollQuery := d.dialect.Rebind(`INSERT INTO polls (name, is_open, max_selections, owner, created_at) VALUES (?, true, ?, ?, ` + d.dialect.Now() + `)` + d.dialect.Returning(pollColumns))
+	choiceQuery := d.dialect.Rebind(`INSERT INTO choices (poll_id, answer, created_at) VALUES (?, ?, ` + d.dialect.Now() + `)`)
+
+	var p *poll
+	err := d.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, pollQuery, name, maxSelections, owner)
+		if err != nil {
+			return classifyErr(err)
+		}
+		if !rows.Next() {
+			rows.Close()
+			return errUnexpectedRows
+		}
+		p = scanPoll(rows)
+		rows.Close()
+
+		for _, answer := range choices {
+			if _, err := tx.ExecContext(ctx, choiceQuery, p.ID, answer); err != nil {
+				return classifyErr(err)
+			}
+		}
 
-	result, err := d.db.Exec(query, pollId, choiceId)
+		return d.recordEvent(ctx, tx, "poll_created", map[string]interface{}{
+			"poll_id": p.ID,
+			"name":    name,
+			"choices": choices,
+			"owner":   owner,
+		})
+	})
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	if rows, err := result.RowsAffected(); err != nil {
-		return err
-	} else if rows == 0 {
-		return notFound
-	}
-	return nil
+	return p, nil
 }
 
-func openDB(postgres string) *sql.DB {
-	if postgres == "" {
-		log.Fatalf("PRIMARY_DB_URL must be set")
+// PollNameTaken reports whether any poll, open or not, is named name.
+func (d *pollDAL) PollNameTaken(ctx context.Context, name string) (bool, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT count(*) FROM polls WHERE name = ?`)
+
+	var n int64
+	if err := d.db.QueryRowContext(ctx, query, name).Scan(&n); err != nil {
+		return false, err
 	}
+	return n > 0, nil
+}
 
-	db, err := sql.Open("postgres", postgres)
+// querySummaries runs a query selecting choice columns and a vote count.
+func (d *pollDAL) querySummaries(ctx context.Context, query string, args ...interface{}) ([]*summary, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		panic(fmt.Sprintf("Error opening postgres connection: %q", err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []*summary
+
+	for rows.Next() {
+		s := &summary{}
+		rows.Scan(&(s.ID), &(s.PollID), &(s.Answer), &(s.Category), &(s.CreatedAt), &(s.Count))
+		summaries = append(summaries, s)
 	}
 
-	db.SetMaxIdleConns(maxIdleConns)
-	db.SetMaxOpenConns(maxOpenConns)
+	return summaries, nil
+}
+
+// RefreshResultCache recomputes the cached tallies of pollId.
+func (d *pollDAL) RefreshResultCache(ctx context.Context, pollId int64) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	return db
+	return d.refreshResultCache(ctx, `c.poll_id = ?`, `poll_id = ?`, pollId)
 }
 
-type app struct {
-	PDAL pollDALer
+// RefreshResultCaches recomputes the cached tallies of every poll flagged
+// with cache_results.
+func (d *pollDAL) RefreshResultCaches(ctx context.Context) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	flagged := `poll_id IN (SELECT id FROM polls WHERE cache_results = true)`
+	return d.refreshResultCache(ctx, `c.`+flagged, flagged)
 }
 
-func (a *app) Results(w http.ResponseWriter, r *http.Request) {
-	// Extract the pollID, call GetResults, display it.
-	pollId, err := a.getPollID(r)
-	if err != nil {
-		w.WriteHeader(400)
-		w.Write([]byte("Bad Request"))
-		return
+// refreshResultCache replaces the cached rows matching pollWhere with fresh
+// counts for the choices matching choiceWhere, and their polls' voter
+// counts from the ballots matching pollWhere. Both conditions take the same
+// args.
+func (d *pollDAL) refreshResultCache(ctx context.Context, choiceWhere, pollWhere string, args ...interface{}) error {
+	deleteQuery := d.dialect.Rebind(`DELETE FROM poll_result_cache WHERE ` + pollWhere)
+	insertQuery := d.dialect.Rebind(`INSERT INTO poll_result_cache (choice_id, poll_id, count, refreshed_at)
+SELECT c.id, c.poll_id, count(a.id), ` + d.dialect.Now() + ` FROM choices c
+LEFT OUTER JOIN answers a ON a.choice_id = c.id
+WHERE ` + choiceWhere + `
+GROUP BY c.id, c.poll_id`)
+	// Polls without votes keep the default of zero voters.
+	votersQuery := d.dialect.Rebind(`UPDATE poll_result_cache SET voter_count = v.voters
+FROM (SELECT poll_id, count(*) AS voters FROM ballots
+  WHERE ` + pollWhere + `
+  GROUP BY poll_id) v
+WHERE poll_result_cache.poll_id = v.poll_id`)
+
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, deleteQuery, args...); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, insertQuery, args...); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, votersQuery, args...)
+		return err
+	})
+}
+
+// anonymousBallot returns a voter_id for the ballot of a vote without a
+// voter, unique so it's never mistaken for a second vote.
+func anonymousBallot() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating anonymous ballot: %w", err)
 	}
+	return "anon:" + hex.EncodeToString(b), nil
+}
 
-	if r.Method != "GET" {
-		w.WriteHeader(405)
-		w.Write([]byte("Method Not Allowed"))
-		return
+// Answer records voterID's vote for choiceIds in pollId, cast from region
+// (which may be empty when unknown). Polls allow between 1 and
+// MaxSelections choices per vote, otherwise errSelectionCount is returned.
+// Each voter gets one vote per poll, a second returns errAlreadyVoted
+// unless it's within the poll's VoteChangeWindow of the first, when it
+// replaces it. An empty voterID isn't deduplicated, but still gets a
+// ballot of its own so voters are counted by ballot.
+func (d *pollDAL) Answer(ctx context.Context, pollId int64, choiceIds []int64, voterID, region string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`INSERT INTO answers (choice_id, poll_id, voter_id, region, created_at)
+SELECT id, poll_id, NULLIF(?, ''), NULLIF(?, ''), ` + d.dialect.Now() + ` FROM choices WHERE poll_id = ? AND id = ?`)
+	ballotQuery := d.dialect.Rebind(`INSERT INTO ballots (poll_id, voter_id, created_at) VALUES (?, ?, ` + d.dialect.Now() + `)`)
+	countQuery := d.dialect.Rebind(`UPDATE polls SET vote_count = vote_count + ? WHERE id = ?`)
+	stateQuery := d.dialect.Rebind(`SELECT is_open AND (close_at IS NULL OR close_at > ` + d.dialect.Now() + `), paused, max_selections, vote_change_window FROM polls WHERE id = ?`)
+	priorQuery := d.dialect.Rebind(`SELECT created_at > ` + d.dialect.Now() + ` - ? * interval '1 second' FROM ballots WHERE poll_id = ? AND voter_id = ? FOR UPDATE`)
+	withdrawQuery := d.dialect.Rebind(`DELETE FROM answers WHERE poll_id = ? AND voter_id = ?`)
+
+	choiceIds = uniqueIDs(choiceIds)
+
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		var open, paused bool
+		var maxSelections, changeWindow int
+		err := tx.QueryRowContext(ctx, stateQuery, pollId).Scan(&open, &paused, &maxSelections, &changeWindow)
+		if err == sql.ErrNoRows {
+			return notFound
+		} else if err != nil {
+			return fmt.Errorf("checking state of poll %d: %w", pollId, err)
+		} else if !open {
+			return errClosed
+		} else if paused {
+			return errPaused
+		} else if len(choiceIds) < 1 || len(choiceIds) > maxSelections {
+			return errSelectionCount
+		}
+
+		for _, choiceId := range choiceIds {
+			if err := d.checkChoice(ctx, tx, pollId, choiceId); err != nil {
+				return err
+			}
+		}
+
+		// A voter who already voted may only replace their vote, keeping
+		// their ballot, while it's still changeable.
+		var withdrawn int64
+		var voted bool
+		if voterID != "" {
+			var changeable bool
+			err := tx.QueryRowContext(ctx, priorQuery, changeWindow, pollId, voterID).Scan(&changeable)
+			if err == nil && !changeable {
+				return errAlreadyVoted
+			} else if err == nil {
+				voted = true
+				result, err := tx.ExecContext(ctx, withdrawQuery, pollId, voterID)
+				if err != nil {
+					return fmt.Errorf("withdrawing vote for poll %d: %w", pollId, err)
+				}
+				if withdrawn, err = result.RowsAffected(); err != nil {
+					return err
+				}
+
+				err = d.recordEvent(ctx, tx, "vote_withdrawn", map[string]int64{
+					"poll_id": pollId,
+					"answers": withdrawn,
+				})
+				if err != nil {
+					return err
+				}
+			} else if err != sql.ErrNoRows {
+				return fmt.Errorf("checking ballot for poll %d: %w", pollId, err)
+			}
+		}
+
+		// The ballot is what limits a voter to one vote, however many
+		// choices it selects.
+		if !voted {
+			ballotVoter := voterID
+			if ballotVoter == "" {
+				ballotVoter, err = anonymousBallot()
+				if err != nil {
+					return err
+				}
+			}
+			_, err = tx.ExecContext(ctx, ballotQuery, pollId, ballotVoter)
+			if isUniqueViolation(err) {
+				return errAlreadyVoted
+			} else if err != nil {
+				return fmt.Errorf("recording ballot for poll %d: %w", pollId, err)
+			}
+		}
+
+		for _, choiceId := range choiceIds {
+			result, err := tx.ExecContext(ctx, query, voterID, region, pollId, choiceId)
+			if err = classifyErr(err); err == errConstraint {
+				return err
+			} else if err != nil {
+				return fmt.Errorf("inserting answer for poll %d choice %d: %w", pollId, choiceId, err)
+			}
+
+			if err := expectRows(result, 1); err != nil {
+				return err
+			}
+
+			err = d.recordEvent(ctx, tx, "vote_cast", map[string]int64{
+				"poll_id":   pollId,
+				"choice_id": choiceId,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, countQuery, int64(len(choiceIds))-withdrawn, pollId); err != nil {
+			return fmt.Errorf("counting vote for poll %d: %w", pollId, err)
+		}
+
+		return nil
+	})
+}
+
+// uniqueIDs returns ids without repeats, keeping the first of each.
+func uniqueIDs(ids []int64) []int64 {
+	seen := make(map[int64]bool, len(ids))
+	var unique []int64
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
 	}
+	return unique
+}
 
-	res, err := a.PDAL.GetResults(pollId)
-	if err == notFound {
-		w.WriteHeader(404)
-		w.Write([]byte("Not Found"))
-		return
+// checkChoice verifies choiceId is one of pollId's choices. It returns
+// notFound when there is no such choice and errChoiceMismatch when it
+// belongs to another poll.
+func (d *pollDAL) checkChoice(ctx context.Context, tx *sql.Tx, pollId, choiceId int64) error {
+	query := d.dialect.Rebind(`SELECT poll_id FROM choices WHERE id = ?`)
+
+	var owner int64
+	err := tx.QueryRowContext(ctx, query, choiceId).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return notFound
 	} else if err != nil {
-		log.Printf("in=app.Results at=GetResults err=%q", err)
-		w.WriteHeader(500)
-		w.Write([]byte("Internal Server Error"))
-		return
+		return fmt.Errorf("looking up choice %d: %w", choiceId, err)
+	} else if owner != pollId {
+		return errChoiceMismatch
 	}
+	return nil
+}
 
-	var buffer bytes.Buffer
-	err = resultsTmpl.Execute(&buffer, res)
-	if err != nil {
-		log.Printf("in=app.Results at=Execute err=%q", err)
-		w.WriteHeader(500)
-		w.Write([]byte("Internal Server Error"))
-		return
+// GetResultsByRegion breaks a poll's votes down by the region they were cast
+// from, with percentages relative to each region's total. Votes without a
+// region are grouped under "".
+func (d *pollDAL) GetResultsByRegion(ctx context.Context, pollId int64) ([]*regionResult, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT COALESCE(a.region, ''), c.id, c.poll_id, c.answer, c.category, c.created_at, count(a.id) FROM answers a
+JOIN choices c ON c.id = a.choice_id
+WHERE c.poll_id = ?
+GROUP BY COALESCE(a.region, ''), c.id, c.poll_id, c.answer, c.category, c.created_at
+ORDER BY COALESCE(a.region, ''), count(a.id) DESC, c.id ASC`)
+
+	if _, err := d.GetByID(ctx, pollId); err != nil {
+		return nil, err
 	}
-	a.layout(w, res.Poll.Name, template.HTML(buffer.String()))
-}
 
-func (a *app) Answer(w http.ResponseWriter, r *http.Request) {
-	// Extract the pollID, choiceID, call Answer(), redirect to Results on success. 500, or 404 otherwise.
-	pollId, err := a.getPollID(r)
+	rows, err := d.db.QueryContext(ctx, query, pollId)
 	if err != nil {
-		w.WriteHeader(400)
-		w.Write([]byte("Bad Request"))
-		return
+		return nil, err
 	}
+	defer rows.Close()
 
-	if r.Method != "POST" {
-		w.WriteHeader(405)
-		w.Write([]byte("Method Not Allowed"))
-		return
-	}
+	var regions []*regionResult
+	var current *regionResult
 
-	choiceId, err := strconv.ParseInt(r.FormValue("choice_id"), 10, 64)
-	if err != nil {
-		w.WriteHeader(400)
-		w.Write([]byte("Bad Request"))
-		return
+	for rows.Next() {
+		var region string
+		s := &summary{}
+		rows.Scan(&region, &(s.ID), &(s.PollID), &(s.Answer), &(s.Category), &(s.CreatedAt), &(s.Count))
+
+		if current == nil || current.Region != region {
+			current = &regionResult{Region: region}
+			regions = append(regions, current)
+		}
+		current.Summaries = append(current.Summaries, s)
+		current.Count += s.Count
 	}
 
-	err = a.PDAL.Answer(pollId, choiceId)
-	if err == notFound {
-		w.WriteHeader(404)
-		w.Write([]byte("Not Found"))
-		return
-	} else if err != nil {
-		log.Printf("in=app.Results at=GetResults err=%q", err)
-		w.WriteHeader(500)
-		w.Write([]byte("Internal Server Error"))
-		return
+	for _, rr := range regions {
+		for _, s := range rr.Summaries {
+			s.Percentage = percentage(s.Count, rr.Count)
+		}
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("/results?poll_id=%d", pollId))
-	w.WriteHeader(302)
-	return
+	return regions, nil
 }
 
-func (a *app) Index(w http.ResponseWriter, r *http.Request) {
-	pollID := int64(1)
+// GetMarginTimeline returns the leader's margin over the runner-up at the
+// end of each bucket in which votes were cast, using cumulative counts.
+func (d *pollDAL) GetMarginTimeline(ctx context.Context, pollId int64, bucket time.Duration) ([]*marginPoint, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	if r.Method != "GET" {
-		w.WriteHeader(405)
-		w.Write([]byte("Method Not Allowed"))
-		return
-	}
+	query := d.dialect.Rebind(`SELECT to_timestamp(floor(extract(epoch from a.created_at) / ?) * ?) AS bucket, a.choice_id, count(*) FROM answers a
+JOIN choices c ON c.id = a.choice_id
+WHERE c.poll_id = ?
+GROUP BY bucket, a.choice_id
+ORDER BY bucket`)
 
-	p, err := a.PDAL.GetByID(1)
-	if err == notFound {
-		w.WriteHeader(404)
-		w.Write([]byte("Not Found"))
-		return
-	} else if err != nil {
-		log.Printf("in=app.Index at=GetLatest err=%q", err)
-		w.WriteHeader(500)
-		w.Write([]byte("Internal Server Error"))
-		return
+	if _, err := d.GetByID(ctx, pollId); err != nil {
+		return nil, err
 	}
 
-	cs, err := a.PDAL.GetChoices(pollID)
-	if err == notFound {
-		w.WriteHeader(404)
-		w.Write([]byte("Not Found"))
-		return
-	} else if err != nil {
-		log.Printf("in=app.Index at=GetChoices err=%q", err)
-		w.WriteHeader(500)
-		w.Write([]byte("Internal Server Error"))
-		return
+	secs := bucket.Seconds()
+	rows, err := d.db.QueryContext(ctx, query, secs, secs, pollId)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	var buffer bytes.Buffer
-	err = indexTmpl.Execute(&buffer, struct {
-		Poll    *poll
-		Choices []*choice
-	}{Poll: p, Choices: cs})
+	var points []*marginPoint
+	totals := make(map[int64]int64)
 
-	a.layout(w, p.Name, template.HTML(buffer.String()))
-}
+	for rows.Next() {
+		var t time.Time
+		var choiceId, count int64
+		rows.Scan(&t, &choiceId, &count)
 
-func (a *app) getPollID(r *http.Request) (int64, error) {
-	return strconv.ParseInt(r.FormValue("poll_id"), 10, 64)
+		if len(points) == 0 || !points[len(points)-1].Time.Equal(t) {
+			points = append(points, &marginPoint{Time: t})
+		}
+		totals[choiceId] += count
+		points[len(points)-1].LeaderID, points[len(points)-1].Margin = leader(totals)
+	}
+
+	return points, nil
 }
 
-func (a *app) layout(w http.ResponseWriter, title string, body template.HTML) {
-	var buffer bytes.Buffer
-	err := layoutTmpl.Execute(&buffer, struct {
-		Body  template.HTML
-		Title string
-	}{Body: body, Title: title})
+// GetVoteTimeline counts a poll's votes per time bucket, oldest first.
+// Buckets without votes are left out.
+func (d *pollDAL) GetVoteTimeline(ctx context.Context, pollId int64, bucket time.Duration) ([]*timelineBucket, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
+	query := d.dialect.Rebind(`SELECT to_timestamp(floor(extract(epoch from a.created_at) / ?) * ?) AS bucket, count(*) FROM answers a
+JOIN choices c ON c.id = a.choice_id
+WHERE c.poll_id = ?
+GROUP BY bucket
+ORDER BY bucket`)
+
+	if _, err := d.GetByID(ctx, pollId); err != nil {
+		return nil, err
+	}
+
+	secs := bucket.Seconds()
+	rows, err := d.db.QueryContext(ctx, query, secs, secs, pollId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []*timelineBucket
+	var total int64
+
+	for rows.Next() {
+		b := &timelineBucket{}
+		rows.Scan(&(b.Time), &(b.Count))
+		total += b.Count
+		b.Total = total
+		buckets = append(buckets, b)
+	}
+
+	return buckets, nil
+}
+
+// GetAnswerTimestamps returns when each answer to pollId was cast, oldest
+// first, by choice id. Nothing identifying the voter is included.
+func (d *pollDAL) GetAnswerTimestamps(ctx context.Context, pollId int64) (map[int64][]time.Time, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT a.choice_id, a.created_at FROM answers a
+JOIN choices c ON c.id = a.choice_id
+WHERE c.poll_id = ?
+ORDER BY a.created_at, a.id`)
+
+	if _, err := d.GetByID(ctx, pollId); err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, pollId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timestamps := make(map[int64][]time.Time)
+
+	for rows.Next() {
+		var choiceId int64
+		var t time.Time
+		rows.Scan(&choiceId, &t)
+		timestamps[choiceId] = append(timestamps[choiceId], t)
+	}
+
+	return timestamps, nil
+}
+
+// ballot is one vote in a poll: the choices a voter picked and when.
+type ballot struct {
+	// VoterID is the voter_id the vote was recorded under, empty for
+	// votes from before voters were tracked.
+	VoterID   string
+	ChoiceIDs []int64
+	CreatedAt time.Time
+}
+
+// GetBallots returns the votes cast in a poll, oldest first. Votes without
+// a voter can't be told apart, so each of their answers is a ballot.
+func (d *pollDAL) GetBallots(ctx context.Context, pollId int64) ([]*ballot, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT a.voter_id, a.choice_id, a.created_at FROM answers a
+JOIN choices c ON c.id = a.choice_id
+WHERE c.poll_id = ?
+ORDER BY a.created_at, a.id`)
+
+	if _, err := d.GetByID(ctx, pollId); err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, pollId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ballots []*ballot
+	byVoter := make(map[string]*ballot)
+
+	for rows.Next() {
+		var voterID sql.NullString
+		var choiceId int64
+		var t time.Time
+		rows.Scan(&voterID, &choiceId, &t)
+
+		b, ok := byVoter[voterID.String]
+		if !ok || !voterID.Valid {
+			b = &ballot{VoterID: voterID.String, CreatedAt: t}
+			ballots = append(ballots, b)
+			if voterID.Valid {
+				byVoter[voterID.String] = b
+			}
+		}
+		b.ChoiceIDs = append(b.ChoiceIDs, choiceId)
+	}
+
+	return ballots, nil
+}
+
+// GetVoterChoices returns the choices voterID voted for in a poll, none if
+// they haven't voted.
+func (d *pollDAL) GetVoterChoices(ctx context.Context, pollId int64, voterID string) ([]int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT choice_id FROM answers WHERE poll_id = ? AND voter_id = ? ORDER BY id`)
+
+	rows, err := d.db.QueryContext(ctx, query, pollId, voterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var choiceIds []int64
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		choiceIds = append(choiceIds, id)
+	}
+
+	return choiceIds, nil
+}
+
+// leader returns the choice with the most votes in totals and its lead over
+// the next best, or a zero id when the top spot is tied.
+func leader(totals map[int64]int64) (int64, int64) {
+	var leaderId, first, second int64
+	for id, n := range totals {
+		switch {
+		case n > first:
+			leaderId, first, second = id, n, first
+		case n == first:
+			leaderId, second = 0, n
+		case n > second:
+			second = n
+		}
+	}
+	return leaderId, first - second
+}
+
+// SetOpen opens or closes a poll. Closing a poll that is already closed,
+// say by two admins at once, is a no-op rather than an error, as is opening
+// an open one. Polls that cache their results get a final refresh on close.
+// Closing snapshots the result, which GetResults returns from then on, and
+// reopening discards the snapshot.
+func (d *pollDAL) SetOpen(ctx context.Context, pollId int64, open bool) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`UPDATE polls SET is_open = ? WHERE id = ? AND is_open IS DISTINCT FROM ?` + d.dialect.Returning("cache_results"))
+	existsQuery := d.dialect.Rebind(`SELECT count(*) FROM polls WHERE id = ?`)
+	discardQuery := d.dialect.Rebind(`DELETE FROM poll_snapshots WHERE poll_id = ?`)
+
+	kind := "poll_opened"
+	if !open {
+		kind = "poll_closed"
+	}
+
+	var cached, changed bool
+	err := d.withTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, open, pollId, open).Scan(&cached)
+		if err == sql.ErrNoRows {
+			// Either there's no such poll or it's already as asked.
+			var n int64
+			if err := tx.QueryRowContext(ctx, existsQuery, pollId).Scan(&n); err != nil {
+				return err
+			} else if n == 0 {
+				return notFound
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		changed = true
+
+		if open {
+			if _, err := tx.ExecContext(ctx, discardQuery, pollId); err != nil {
+				return fmt.Errorf("discarding snapshot of poll %d: %w", pollId, err)
+			}
+		}
+
+		return d.recordEvent(ctx, tx, kind, map[string]int64{
+			"poll_id": pollId,
+		})
+	})
+	if err != nil || !changed || open {
+		return err
+	}
+
+	if cached {
+		if err := d.RefreshResultCache(ctx, pollId); err != nil {
+			return err
+		}
+	}
+	return d.snapshotResult(ctx, pollId)
+}
+
+// snapshotResult stores the current result of the closed poll pollId in
+// poll_snapshots. Reopening discards snapshots, so there's normally none
+// to replace.
+func (d *pollDAL) snapshotResult(ctx context.Context, pollId int64) error {
+	query := d.dialect.Rebind(`INSERT INTO poll_snapshots (poll_id, result, created_at) VALUES (?, ?, ` + d.dialect.Now() + `)
+ON CONFLICT (poll_id) DO UPDATE SET result = EXCLUDED.result, created_at = EXCLUDED.created_at`)
+
+	res, err := d.GetResults(ctx, pollId, byVotes)
+	if err != nil {
+		return err
+	}
+	raw, err := encodeSnapshot(res)
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.db.ExecContext(ctx, query, pollId, string(raw)); err != nil {
+		return fmt.Errorf("snapshotting poll %d: %w", pollId, err)
+	}
+	return nil
+}
+
+// RenamePoll changes the name of a poll.
+func (d *pollDAL) RenamePoll(ctx context.Context, pollId int64, name string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`UPDATE polls SET name = ? WHERE id = ?`)
+
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, name, pollId)
+		if err != nil {
+			return classifyErr(err)
+		}
+		if err := expectRows(result, 1); err != nil {
+			return err
+		}
+
+		return d.recordEvent(ctx, tx, "poll_renamed", map[string]interface{}{
+			"poll_id": pollId,
+			"name":    name,
+		})
+	})
+}
+
+// UpdateChoice changes the answer text of a choice, keeping its votes.
+func (d *pollDAL) UpdateChoice(ctx context.Context, choiceId int64, answer string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`UPDATE choices SET answer = ? WHERE id = ?`)
+
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, answer, choiceId)
+		if err != nil {
+			return classifyErr(err)
+		}
+		if err := expectRows(result, 1); err != nil {
+			return err
+		}
+
+		return d.recordEvent(ctx, tx, "choice_updated", map[string]interface{}{
+			"choice_id": choiceId,
+			"answer":    answer,
+		})
+	})
+}
+
+// AddChoice adds a choice answering answer to pollId.
+func (d *pollDAL) AddChoice(ctx context.Context, pollId int64, answer string) (*choice, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`INSERT INTO choices (poll_id, answer, created_at)
+SELECT id, ?, ` + d.dialect.Now() + ` FROM polls WHERE id = ?` + d.dialect.Returning("id, poll_id, answer, category, created_at"))
+
+	var c *choice
+	err := d.withTx(ctx, func(tx *sql.Tx) error {
+		c = &choice{}
+		err := tx.QueryRowContext(ctx, query, answer, pollId).Scan(&c.ID, &c.PollID, &c.Answer, &c.Category, &c.CreatedAt)
+		if err == sql.ErrNoRows {
+			return notFound
+		} else if err != nil {
+			return classifyErr(err)
+		}
+
+		return d.recordEvent(ctx, tx, "choice_added", map[string]interface{}{
+			"poll_id":   pollId,
+			"choice_id": c.ID,
+			"answer":    answer,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// DeletePoll removes a poll along with its choices, answers and anything
+// else referring to them.
+func (d *pollDAL) DeletePoll(ctx context.Context, pollId int64) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	// Children before parents, to satisfy the foreign keys.
+	queries := []string{
+		`DELETE FROM answers WHERE choice_id IN (SELECT id FROM choices WHERE poll_id = ?)`,
+		`DELETE FROM impressions WHERE choice_id IN (SELECT id FROM choices WHERE poll_id = ?)`,
+		`DELETE FROM poll_result_cache WHERE poll_id = ?`,
+		`DELETE FROM poll_snapshots WHERE poll_id = ?`,
+		`DELETE FROM ballots WHERE poll_id = ?`,
+		`DELETE FROM choices WHERE poll_id = ?`,
+	}
+	pollQuery := d.dialect.Rebind(`DELETE FROM polls WHERE id = ?`)
+
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		for _, q := range queries {
+			if _, err := tx.ExecContext(ctx, d.dialect.Rebind(q), pollId); err != nil {
+				return err
+			}
+		}
+
+		result, err := tx.ExecContext(ctx, pollQuery, pollId)
+		if err != nil {
+			return err
+		}
+		if err := expectRows(result, 1); err != nil {
+			return err
+		}
+
+		return d.recordEvent(ctx, tx, "poll_deleted", map[string]int64{
+			"poll_id": pollId,
+		})
+	})
+}
+
+// Ping checks the database is reachable, giving up when ctx is done.
+func (d *pollDAL) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// PausePoll stops a poll accepting votes without closing it.
+func (d *pollDAL) PausePoll(ctx context.Context, pollId int64) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	return d.setPaused(ctx, pollId, true)
+}
+
+// ResumePoll lets a paused poll accept votes again.
+func (d *pollDAL) ResumePoll(ctx context.Context, pollId int64) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	return d.setPaused(ctx, pollId, false)
+}
+
+func (d *pollDAL) setPaused(ctx context.Context, pollId int64, paused bool) error {
+	query := d.dialect.Rebind(`UPDATE polls SET paused = ? WHERE id = ?`)
+
+	kind := "poll_resumed"
+	if paused {
+		kind = "poll_paused"
+	}
+
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, paused, pollId)
+		if err != nil {
+			return err
+		}
+
+		if err := expectRows(result, 1); err != nil {
+			return err
+		}
+
+		return d.recordEvent(ctx, tx, kind, map[string]int64{
+			"poll_id": pollId,
+		})
+	})
+}
+
+// ReconcileVoteCounts recomputes the denormalized vote_count of every poll
+// from its answers, returning how many polls had drifted.
+func (d *pollDAL) ReconcileVoteCounts(ctx context.Context) (int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE polls p SET vote_count = t.count
+FROM (SELECT p2.id, count(a.id) AS count FROM polls p2
+  LEFT OUTER JOIN choices c ON c.poll_id = p2.id
+  LEFT OUTER JOIN answers a ON a.choice_id = c.id
+  GROUP BY p2.id) t
+WHERE p.id = t.id AND p.vote_count <> t.count`
+
+	result, err := d.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// CloseAllPolls closes every open poll in one statement and returns how
+// many were closed.
+func (d *pollDAL) CloseAllPolls(ctx context.Context) (int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE polls SET is_open = false WHERE is_open = true`
+
+	var closed int64
+	err := d.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		closed, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		return d.recordEvent(ctx, tx, "all_polls_closed", map[string]int64{
+			"closed": closed,
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return closed, nil
+}
+
+// CloseExpiredPolls closes the open polls whose close_at has passed,
+// returning how many it closed. Answer already refuses their votes; this
+// makes them show as closed everywhere else too.
+func (d *pollDAL) CloseExpiredPolls(ctx context.Context) (int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE polls SET is_open = false WHERE is_open = true AND close_at <= ` + d.dialect.Now()
+
+	var closed int64
+	err := d.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		closed, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if closed == 0 {
+			return nil
+		}
+
+		return d.recordEvent(ctx, tx, "expired_polls_closed", map[string]int64{
+			"closed": closed,
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return closed, nil
+}
+
+// GetEmptyPolls returns polls created more than olderThan ago that have
+// never received a vote, oldest first.
+func (d *pollDAL) GetEmptyPolls(ctx context.Context, olderThan time.Duration) ([]*poll, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT ` + pollColumns + ` FROM polls p
+WHERE p.created_at < ` + d.dialect.Now() + ` - ? * interval '1 second'
+AND NOT EXISTS (
+  SELECT 1 FROM choices c
+  JOIN answers a ON a.choice_id = c.id
+  WHERE c.poll_id = p.id)
+ORDER BY p.created_at`)
+
+	rows, err := d.db.QueryContext(ctx, query, olderThan.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var polls []*poll
+
+	for rows.Next() {
+		polls = append(polls, scanPoll(rows))
+	}
+
+	return polls, nil
+}
+
+// ListPolls pages through all polls, newest first.
+func (d *pollDAL) ListPolls(ctx context.Context, limit, offset int) ([]*poll, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT ` + pollColumns + ` FROM polls ORDER BY created_at DESC LIMIT ? OFFSET ?`)
+
+	rows, err := d.db.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var polls []*poll
+
+	for rows.Next() {
+		polls = append(polls, scanPoll(rows))
+	}
+
+	return polls, nil
+}
+
+// ListPollsByOwner returns a page of the polls created by owner, newest
+// first.
+func (d *pollDAL) ListPollsByOwner(ctx context.Context, owner string, limit, offset int) ([]*poll, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT ` + pollColumns + ` FROM polls WHERE owner = ? ORDER BY created_at DESC LIMIT ? OFFSET ?`)
+
+	rows, err := d.db.QueryContext(ctx, query, owner, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var polls []*poll
+
+	for rows.Next() {
+		polls = append(polls, scanPoll(rows))
+	}
+
+	return polls, nil
+}
+
+// AnswerByText records a vote for the choice of pollId whose answer matches
+// answerText once both are normalized and mapped through the synonym table.
+// It returns errNoMatchingChoice or errAmbiguousChoice unless exactly one
+// choice matches.
+func (d *pollDAL) AnswerByText(ctx context.Context, pollId int64, answerText, voterID, region string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := d.GetByID(ctx, pollId); err != nil {
+		return err
+	}
+
+	// Matching against some of the choices could pick the wrong one.
+	choices, truncated, err := d.GetChoices(ctx, pollId)
+	if err != nil {
+		return err
+	} else if truncated {
+		return errTooManyChoices
+	}
+
+	synonyms, err := d.getSynonyms(ctx)
+	if err != nil {
+		return err
+	}
+
+	want := synonyms.canonical(answerText)
+	var match *choice
+	for _, c := range choices {
+		if synonyms.canonical(c.Answer) != want {
+			continue
+		}
+		if match != nil {
+			return errAmbiguousChoice
+		}
+		match = c
+	}
+
+	if match == nil {
+		return errNoMatchingChoice
+	}
+
+	return d.Answer(ctx, pollId, []int64{match.ID}, voterID, region)
+}
+
+// synonyms maps normalized answers to the normalized canonical answer they
+// should be treated as, e.g. "u.s." and "united states" to "usa".
+type synonyms map[string]string
+
+// canonical normalizes answer and resolves it through the synonyms.
+func (s synonyms) canonical(answer string) string {
+	n := normalizeAnswer(answer)
+	if c, ok := s[n]; ok {
+		return c
+	}
+	return n
+}
+
+// getSynonyms loads the answer synonym table. It is empty unless synonyms
+// have been configured, in which case answers are compared as-is.
+func (d *pollDAL) getSynonyms(ctx context.Context) (synonyms, error) {
+	query := `SELECT synonym, canonical FROM answer_synonyms`
+
+	rows, err := d.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	s := make(synonyms)
+
+	for rows.Next() {
+		var synonym, canonical string
+		rows.Scan(&synonym, &canonical)
+		s[normalizeAnswer(synonym)] = normalizeAnswer(canonical)
+	}
+
+	return s, nil
+}
+
+// normalizeAnswer folds case and collapses whitespace so that answers can be
+// compared by their text. A poll's answers are unique by it, and the index
+// enforcing that in migrations/0008_normalized_answers.sql must match.
+func normalizeAnswer(answer string) string {
+	return strings.ToLower(strings.Join(strings.Fields(answer), " "))
+}
+
+// PurgeOrphanAnswers deletes answers whose choice, or the choice's poll, no
+// longer exists, as can happen after deleting rows by hand. It returns how
+// many answers were removed.
+func (d *pollDAL) PurgeOrphanAnswers(ctx context.Context) (int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM answers a WHERE NOT EXISTS (
+  SELECT 1 FROM choices c
+  JOIN polls p ON p.id = c.poll_id
+  WHERE c.id = a.choice_id)`
+
+	var purged int64
+	err := d.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		purged, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		return d.recordEvent(ctx, tx, "orphan_answers_purged", map[string]int64{
+			"purged": purged,
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// withTx runs fn inside a transaction, committing if it returns nil and
+// rolling back otherwise.
+func (d *pollDAL) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// recordEvent appends a mutation of the given kind to the event log as part
+// of tx, so the event is only kept if the mutation is.
+func (d *pollDAL) recordEvent(ctx context.Context, tx *sql.Tx, kind string, payload interface{}) error {
+	query := d.dialect.Rebind(`INSERT INTO events (kind, payload, created_at) VALUES (?, ?, ` + d.dialect.Now() + `)`)
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, query, kind, string(raw))
+	return err
+}
+
+// GetEvents pages through the event log, most recent first.
+func (d *pollDAL) GetEvents(ctx context.Context, limit, offset int) ([]*event, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT id, kind, payload, created_at FROM events ORDER BY id DESC LIMIT ? OFFSET ?`)
+
+	rows, err := d.db.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*event
+
+	for rows.Next() {
+		e := &event{}
+		var payload []byte
+		rows.Scan(&(e.ID), &(e.Kind), &payload, &(e.CreatedAt))
+		e.Payload = json.RawMessage(payload)
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// GetVotesByHourOfDay counts a poll's votes by the hour of day they were
+// cast, in the DAL's timezone. Hours without votes are zero.
+func (d *pollDAL) GetVotesByHourOfDay(ctx context.Context, pollId int64) ([24]int64, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT extract(hour from (a.created_at AT TIME ZONE 'UTC') AT TIME ZONE ?)::int AS hour, count(*) FROM answers a
+JOIN choices c ON c.id = a.choice_id
+WHERE c.poll_id = ?
+GROUP BY hour`)
+
+	var hours [24]int64
+
+	if _, err := d.GetByID(ctx, pollId); err != nil {
+		return hours, err
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, d.timezone, pollId)
+	if err != nil {
+		return hours, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hour int
+		var count int64
+		rows.Scan(&hour, &count)
+		if hour >= 0 && hour < len(hours) {
+			hours[hour] = count
+		}
+	}
+
+	return hours, nil
+}
+
+// GetResultsDelta returns each choice's total votes and the votes it
+// gained at or after since. A since in the future yields zero changes.
+func (d *pollDAL) GetResultsDelta(ctx context.Context, pollId int64, since time.Time) ([]*delta, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT c.id, c.answer, count(a.id),
+  count(a.id) FILTER (WHERE a.created_at >= (?::timestamptz AT TIME ZONE 'UTC'))
+FROM choices c
+LEFT OUTER JOIN answers a ON a.choice_id = c.id
+WHERE c.poll_id = ?
+GROUP BY c.id, c.answer
+ORDER BY c.id`)
+
+	if _, err := d.GetByID(ctx, pollId); err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, since, pollId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deltas []*delta
+
+	for rows.Next() {
+		dl := &delta{}
+		rows.Scan(&(dl.ChoiceID), &(dl.Answer), &(dl.Count), &(dl.Change))
+		if before := dl.Count - dl.Change; before > 0 {
+			dl.RelativeChange = float64(dl.Change) / float64(before)
+		}
+		deltas = append(deltas, dl)
+	}
+
+	return deltas, nil
+}
+
+// RecordImpressions adds counts, keyed by choice id, to the impression
+// totals in a single transaction.
+func (d *pollDAL) RecordImpressions(ctx context.Context, counts map[int64]int64) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`INSERT INTO impressions (choice_id, count) VALUES (?, ?)
+ON CONFLICT (choice_id) DO UPDATE SET count = impressions.count + EXCLUDED.count`)
+
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		for choiceId, count := range counts {
+			if _, err := tx.ExecContext(ctx, query, choiceId, count); err != nil {
+				return classifyErr(err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetCTR returns the impressions, votes and their ratio for each of a poll's
+// choices. Choices that were never shown have a zero rate.
+func (d *pollDAL) GetCTR(ctx context.Context, pollId int64) ([]*ctr, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	query := d.dialect.Rebind(`SELECT c.id, c.answer, COALESCE(i.count, 0),
+  (SELECT count(*) FROM answers a WHERE a.choice_id = c.id)
+FROM choices c
+LEFT OUTER JOIN impressions i ON i.choice_id = c.id
+WHERE c.poll_id = ?
+ORDER BY c.id`)
+
+	if _, err := d.GetByID(ctx, pollId); err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, pollId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ctrs []*ctr
+
+	for rows.Next() {
+		c := &ctr{}
+		rows.Scan(&(c.ChoiceID), &(c.Answer), &(c.Impressions), &(c.Votes))
+		if c.Impressions > 0 {
+			c.Rate = float64(c.Votes) / float64(c.Impressions)
+		}
+		ctrs = append(ctrs, c)
+	}
+
+	return ctrs, nil
+}
+
+// maxExactVotes is the largest vote count a float64 represents exactly.
+// Totals beyond it are implausible for a real poll.
+const maxExactVotes = 1 << 53
+
+// addVotes adds n to total, saturating at math.MaxInt64 and reporting false
+// if the sum would have overflowed.
+func addVotes(total, n int64) (int64, bool) {
+	if n > 0 && total > math.MaxInt64-n {
+		return math.MaxInt64, false
+	}
+	return total + n, true
+}
+
+// percentage returns count as a fraction of total. Counts too large to be
+// represented exactly as float64 are divided as exact rationals first, so
+// the result is correctly rounded.
+func percentage(count, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	if count <= maxExactVotes && total <= maxExactVotes {
+		return float64(count) / float64(total)
+	}
+	f, _ := new(big.Rat).SetFrac64(count, total).Float64()
+	return f
+}
+
+// entropy returns the Shannon entropy in bits of the distribution given by
+// counts. Zero counts don't contribute, and an empty distribution has none.
+func entropy(counts []int64) float64 {
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+
+	var h float64
+	for _, c := range counts {
+		if c <= 0 {
+			continue
+		}
+		p := percentage(c, total)
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// classifyErr maps integrity constraint violations reported by Postgres to
+// errConstraint, leaving driver and connection errors untouched.
+func classifyErr(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Class() == "23" {
+		return errConstraint
+	}
+	return err
+}
+
+// isUniqueViolation reports whether err is Postgres rejecting a duplicate
+// key.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code.Name() == "unique_violation"
+}
+
+// expectRows checks that exactly n rows were affected by result. Zero rows
+// means the target didn't exist, anything else is unexpected.
+func expectRows(result sql.Result, n int64) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case rows == n:
+		return nil
+	case rows == 0:
+		return notFound
+	default:
+		return errUnexpectedRows
+	}
+}
+
+// dbPool holds the connection settings openDB applied.
+type dbPool struct {
+	MaxIdleConns    int
+	MaxOpenConns    int
+	ConnMaxLifetime time.Duration
+
+	// ConnectRetries is how many more times openDB pings the database
+	// after a failed first attempt, doubling ConnectBackoff in between.
+	ConnectRetries int
+	ConnectBackoff time.Duration
+}
+
+func openDB(postgres string) (*sql.DB, dbPool) {
+	if postgres == "" {
+		log.Fatalf("PRIMARY_DB_URL must be set")
+	}
+
+	db, err := sql.Open("postgres", postgres)
+	if err != nil {
+		panic(fmt.Sprintf("Error opening postgres connection: %q", err))
+	}
+
+	pool := dbPool{
+		MaxIdleConns:    envInt("DB_MAX_IDLE_CONNS", defaultMaxIdleConns),
+		MaxOpenConns:    envInt("DB_MAX_OPEN_CONNS", defaultMaxOpenConns),
+		ConnMaxLifetime: envDuration("DB_CONN_MAX_LIFETIME", 0),
+		ConnectRetries:  envInt("DB_CONNECT_RETRIES", 5),
+		ConnectBackoff:  envDuration("DB_CONNECT_BACKOFF", time.Second),
+	}
+
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
+	// sql.Open doesn't connect, so wait here for a database that is still
+	// starting rather than failing the first request.
+	backoff := pool.ConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err := db.Ping()
+		if err == nil {
+			break
+		}
+		if attempt > pool.ConnectRetries {
+			log.Fatalf("Error connecting to postgres after %d attempts: %q", attempt, err)
+		}
+
+		log.Printf("in=openDB at=Ping attempt=%d retry_in=%s err=%q", attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return db, pool
+}
+
+// envInt reads a non-negative integer setting, falling back to def with a
+// warning when it's unset or invalid.
+func envInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		log.Printf("in=envInt at=Atoi name=%s value=%q warning=%q", name, raw, "using default")
+		return def
+	}
+	return n
+}
+
+// envDuration reads a duration setting like "5m", falling back to def with
+// a warning when it's unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		log.Printf("in=envDuration at=ParseDuration name=%s value=%q warning=%q", name, raw, "using default")
+		return def
+	}
+	return d
+}
+
+type app struct {
+	PDAL pollDALer
+
+	// TemplatesDir, when set, holds <name>.html files overriding the
+	// built-in templates. With TemplateReload they are re-parsed on every
+	// request so edits show up without a restart.
+	TemplatesDir   string
+	TemplateReload bool
+
+	// Config holds the resolved configuration, by environment variable
+	// name, for troubleshooting deploys.
+	Config map[string]string
+
+	// MaxRenderedResults caps how many choices the results page lists
+	// before collapsing the rest into an "Other" row. Zero means no cap.
+	MaxRenderedResults int
+
+	// NoOpenPoll picks what Index does when no poll is open: "landing"
+	// (the default) renders a friendly page, "notfound" responds 404 and
+	// "recent" shows the most recent poll even if closed.
+	NoOpenPoll string
+
+	// ReadOnly refuses every mutation while still serving reads, for
+	// maintenance windows.
+	ReadOnly bool
+
+	// Limits are the limits this deployment enforces, as reported by Info.
+	Limits map[string]int64
+
+	// Geo resolves the region votes are cast from.
+	Geo geolocator
+
+	// Impressions, when non-nil, records which choices were shown.
+	Impressions *impressionLogger
+
+	// AdminUser and AdminPass are the basic auth credentials for admin
+	// handlers, which are disabled unless both are set.
+	AdminUser string
+	AdminPass string
+
+	// ShuffleSeed, when set, seeds the order of shuffled choices instead of
+	// the clock.
+	ShuffleSeed func() int64
+
+	// draining is set (atomically) once shutdown begins; votes are then
+	// refused while reads keep being served.
+	draining int32
+}
+
+// SetDraining toggles whether the app is refusing new votes ahead of
+// shutdown.
+func (a *app) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&a.draining, v)
+}
+
+func (a *app) isDraining() bool {
+	return atomic.LoadInt32(&a.draining) == 1
+}
+
+// acceptingWrites responds 503 and returns false when mutations are
+// refused, because the app is read-only or draining for shutdown.
+func (a *app) acceptingWrites(w http.ResponseWriter) bool {
+	switch {
+	case a.ReadOnly:
+		w.WriteHeader(503)
+		w.Write([]byte("Read-Only Mode"))
+		return false
+	case a.isDraining():
+		w.WriteHeader(503)
+		w.Write([]byte("Service Draining"))
+		return false
+	}
+	return true
+}
+
+func (a *app) Results(w http.ResponseWriter, r *http.Request) {
+	// Extract the pollID, call GetResults, display it.
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	// /api/results always answers in JSON and /results.csv in CSV,
+	// /results negotiates.
+	var format string
+	switch r.URL.Path {
+	case "/api/results":
+		format = "application/json"
+	case "/results.csv":
+		format = "text/csv"
+	default:
+		w.Header().Set("Vary", "Accept")
+		format = negotiate(r, "text/html", "application/json", "text/csv")
+	}
+
+	// API clients vote with the voter cookie issued along with results.
+	if format == "application/json" {
+		if _, err := ensureVoterCookie(w, r); err != nil {
+			log.Printf("in=app.Results at=ensureVoterCookie request_id=%s err=%q", requestID(r.Context()), err)
+			a.writeError(w, r, 500, "Internal Server Error")
+			return
+		}
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	order, ok := parseResultOrder(r.FormValue("sort"))
+	if !ok {
+		a.writeError(w, r, 400, "sort must be votes or order")
+		return
+	}
+
+	res, err := a.PDAL.GetResults(r.Context(), pollId, order)
+	if err == notFound {
+		a.writeError(w, r, 404, "Not Found")
+		return
+	} else if err != nil {
+		log.Printf("in=app.Results at=GetResults request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+
+	if a.resultsOwnerOnly(r, res.Poll) {
+		a.writeError(w, r, 403, "results visible to the poll owner only")
+		return
+	}
+	if a.resultsHidden(r, res.Poll) {
+		if format == "text/html" {
+			a.hiddenResults(w, r, res.Poll)
+		} else {
+			a.writeError(w, r, 403, "results hidden until poll closes")
+		}
+		return
+	}
+
+	// Dashboards polling for results can skip the body until something
+	// they'd see changes.
+	etag, err := resultsETag(r, res, format)
+	if err != nil {
+		log.Printf("in=app.Results at=resultsETag request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(304)
+		return
+	}
+
+	switch format {
+	case "application/json":
+		a.writeJSON(w, r, 200, res)
+		return
+	case "text/csv":
+		if r.URL.Path == "/results.csv" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"poll-%s.csv\"", ids.Encode("poll", pollId)))
+		}
+		a.writeCSV(w, r, res)
+		return
+	}
+
+	// ?view=bars draws each choice as a bar instead of a list item.
+	view := "results"
+	if r.FormValue("view") == "bars" {
+		view = "bars"
+	}
+
+	tmpl, err := a.template(view)
+	if err != nil {
+		log.Printf("in=app.Results at=template request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+
+	max := a.MaxRenderedResults
+	if r.FormValue("all") == "true" {
+		max = 0
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, newResultsView(res, max))
+	if err != nil {
+		log.Printf("in=app.Results at=Execute request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+	if err := a.layout(w, res.Poll.Name, res.Poll.Theme, template.HTML(buffer.String())); err != nil {
+		log.Printf("in=app.Results at=layout request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+	}
+}
+
+// resultsHidden reports whether p's tallies should be kept from whoever
+// sent r: the poll hides them, is still open, and r isn't from an admin.
+func (a *app) resultsHidden(r *http.Request, p *poll) bool {
+	hides := p.ResultsHidden || p.ResultsVisibility == visibilityAfterClose
+	return hides && p.IsOpen && !a.isAdmin(r)
+}
+
+// resultsOwnerOnly reports whether p's tallies are kept from whoever sent r
+// because only its owner may see them. Polls from before owners were
+// recorded are visible to any admin.
+func (a *app) resultsOwnerOnly(r *http.Request, p *poll) bool {
+	if p.ResultsVisibility != visibilityOwner {
+		return false
+	}
+
+	user, _, _ := r.BasicAuth()
+	return !a.isAdmin(r) || (p.Owner != "" && user != p.Owner)
+}
+
+// checkResultsVisible responds 403 when the poll given by pollId keeps its
+// results from whoever sent r, and reports whether the handler should
+// carry on. Errors looking up the poll are left to the handler.
+func (a *app) checkResultsVisible(w http.ResponseWriter, r *http.Request, pollId int64) bool {
+	p, err := a.PDAL.GetByID(r.Context(), pollId)
+	if err != nil {
+		return true
+	}
+
+	if a.resultsOwnerOnly(r, p) {
+		a.writeError(w, r, 403, "results visible to the poll owner only")
+		return false
+	} else if a.resultsHidden(r, p) {
+		a.writeError(w, r, 403, "results hidden until poll closes")
+		return false
+	}
+	return true
+}
+
+// hiddenResults renders the page shown instead of p's results while they're
+// hidden.
+func (a *app) hiddenResults(w http.ResponseWriter, r *http.Request, p *poll) {
+	tmpl, err := a.template("hidden")
+	if err != nil {
+		log.Printf("in=app.hiddenResults at=template request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, p)
+	if err != nil {
+		log.Printf("in=app.hiddenResults at=Execute request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	if err := a.layout(w, p.Name, p.Theme, template.HTML(buffer.String())); err != nil {
+		log.Printf("in=app.hiddenResults at=layout request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+	}
+}
+
+func (a *app) Answer(w http.ResponseWriter, r *http.Request) {
+	// Extract the pollID, choiceID, call Answer(), redirect to Results on success. 500, or 404 otherwise.
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+
+	vote, err := parseVote(w, r)
+	if err != nil {
+		a.writeError(w, r, 400, "malformed vote: "+err.Error())
+		return
+	}
+
+	// Votes are counted once per voter cookie, which CSRF checks need too.
+	voter, ok := voterID(r)
+	if !ok || (!csrfSafe(r) && !validCSRF(r, vote.CSRFToken)) {
+		a.writeError(w, r, 403, "Forbidden")
+		return
+	}
+
+	pollId, err := ids.Decode("poll", string(vote.PollID))
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	if !a.acceptingWrites(w) {
+		return
+	}
+
+	// Integrations that only know an answer's label may send it as
+	// "answer" instead of a choice_id.
+	region := a.Geo.Region(clientIP(r))
+
+	var choiceIds []int64
+	if vote.Answer != "" && len(vote.ChoiceIDs) == 0 {
+		err = a.PDAL.AnswerByText(r.Context(), pollId, vote.Answer, voter, region)
+	} else {
+		if len(vote.ChoiceIDs) == 0 {
+			a.writeError(w, r, 400, "choice_id required")
+			return
+		}
+
+		choiceIds, err = decodeIDs("choice", vote.ChoiceIDs)
+		if err != nil {
+			a.writeError(w, r, 400, "invalid choice_id")
+			return
+		}
+		err = a.PDAL.Answer(r.Context(), pollId, choiceIds, voter, region)
+	}
+
+	if err == notFound {
+		a.writeError(w, r, 404, "Not Found")
+		return
+	} else if err == errClosed {
+		a.writeError(w, r, 409, "Poll Closed")
+		return
+	} else if err == errPaused {
+		a.writeError(w, r, 423, "Voting Paused")
+		return
+	} else if err == errAlreadyVoted {
+		a.writeError(w, r, 409, "You've already voted in this poll, thanks!")
+		return
+	} else if err == errNoMatchingChoice || err == errAmbiguousChoice || err == errTooManyChoices {
+		a.writeError(w, r, 422, err.Error())
+		return
+	} else if err == errSelectionCount {
+		a.writeError(w, r, 422, "Please pick between 1 and the number of choices this poll allows")
+		return
+	} else if err == errChoiceMismatch {
+		a.writeError(w, r, 422, "That choice isn't part of this poll")
+		return
+	} else if err == errConstraint {
+		a.writeError(w, r, 409, "Conflict")
+		return
+	} else if err != nil {
+		log.Printf("in=app.Answer at=Answer request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+
+	location := withBasePath("/results?poll_id=" + ids.Encode("poll", pollId))
+	w.Header().Set("Location", location)
+
+	// API clients get the vote back rather than a redirect to follow.
+	if isJSON(r) {
+		a.writeJSON(w, r, 201, struct {
+			PollID  string `json:"poll_id"`
+			Results string `json:"results"`
+		}{PollID: ids.Encode("poll", pollId), Results: location})
+		return
+	}
+
+	w.WriteHeader(302)
+	return
+}
+
+func (a *app) Hourly(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	if !a.checkResultsVisible(w, r, pollId) {
+		return
+	}
+
+	hours, err := a.PDAL.GetVotesByHourOfDay(r.Context(), pollId)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.Hourly at=GetVotesByHourOfDay request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID string    `json:"poll_id"`
+		Hours  [24]int64 `json:"hours"`
+	}{PollID: ids.Encode("poll", pollId), Hours: hours})
+}
+
+func (a *app) ResultsDelta(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	since, err := time.Parse(time.RFC3339, r.FormValue("since"))
+	if err != nil {
+		a.writeError(w, r, 400, "since must be an RFC 3339 time")
+		return
+	}
+
+	if !a.checkResultsVisible(w, r, pollId) {
+		return
+	}
+
+	deltas, err := a.PDAL.GetResultsDelta(r.Context(), pollId, since)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.ResultsDelta at=GetResultsDelta request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID  string   `json:"poll_id"`
+		Since   string   `json:"since"`
+		Choices []*delta `json:"choices"`
+	}{PollID: ids.Encode("poll", pollId), Since: since.Format(time.RFC3339), Choices: deltas})
+}
+
+// Info describes the server version, optional features and limits so that
+// clients can adapt to what this deployment supports.
+func (a *app) Info(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		Version  string           `json:"version"`
+		Features map[string]bool  `json:"features"`
+		Limits   map[string]int64 `json:"limits"`
+	}{
+		Version: version,
+		Features: map[string]bool{
+			"voter_tracking": true,
+			"multi_select":   true,
+			"hidden_results": true,
+			"captcha":        false,
+		},
+		Limits: a.Limits,
+	})
+}
+
+func (a *app) CTR(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	if !a.checkResultsVisible(w, r, pollId) {
+		return
+	}
+
+	ctrs, err := a.PDAL.GetCTR(r.Context(), pollId)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.CTR at=GetCTR request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID  string `json:"poll_id"`
+		Choices []*ctr `json:"choices"`
+	}{PollID: ids.Encode("poll", pollId), Choices: ctrs})
+}
+
+// Polls lists polls on GET and creates one on POST.
+func (a *app) Polls(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		a.requireAdmin(a.CreatePoll)(w, r)
+		return
+	}
+	a.ListPolls(w, r)
+}
+
+// ListPolls renders a page of polls, newest first. limit defaults to 20 and
+// is capped at 100.
+func (a *app) ListPolls(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET", "POST") {
+		return
+	}
+
+	limit, offset := 20, 0
+	if raw := r.FormValue("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			a.writeError(w, r, 400, "limit must be a number")
+			return
+		}
+		if n > 0 {
+			limit = n
+		}
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	if raw := r.FormValue("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			a.writeError(w, r, 400, "offset must be a non-negative number")
+			return
+		}
+		offset = n
+	}
+
+	// ?owner= narrows the list to the polls one admin created.
+	owner := r.FormValue("owner")
+
+	var polls []*poll
+	var err error
+	if owner != "" {
+		polls, err = a.PDAL.ListPollsByOwner(r.Context(), owner, limit, offset)
+	} else {
+		polls, err = a.PDAL.ListPolls(r.Context(), limit, offset)
+	}
+	if err != nil {
+		log.Printf("in=app.ListPolls at=ListPolls request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	tmpl, err := a.template("polls")
+	if err != nil {
+		log.Printf("in=app.ListPolls at=template request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	// Prev and Next are the offsets of the neighbouring pages, or -1 when
+	// there isn't one. A full page may have more after it.
+	prev, next := -1, -1
+	if offset > 0 {
+		prev = offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+	}
+	if len(polls) == limit {
+		next = offset + limit
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, struct {
+		Polls []*poll
+		Owner string
+		Limit int
+		Prev  int
+		Next  int
+	}{Polls: polls, Owner: owner, Limit: limit, Prev: prev, Next: next})
+	if err != nil {
+		log.Printf("in=app.ListPolls at=Execute request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	if err := a.layout(w, "Polls", "", template.HTML(buffer.String())); err != nil {
+		log.Printf("in=app.ListPolls at=layout request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+	}
+}
+
+// CreatePoll creates a poll from a name and two or more repeated choice
+// values, then redirects to it. With warn_on_duplicate_name=true, a Warning
+// header notes when another poll already has the name.
+func (a *app) CreatePoll(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+
+	if !a.acceptingWrites(w) {
+		return
+	}
+
+	r.ParseForm()
+	name, choices, err := validatePoll(r.PostFormValue("name"), r.PostForm["choice"])
+	if err != nil {
+		w.WriteHeader(422)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	maxSelections := 1
+	if raw := r.PostFormValue("max_selections"); raw != "" {
+		maxSelections, err = strconv.Atoi(raw)
+		if err != nil {
+			a.writeError(w, r, 400, "max_selections must be a number")
+			return
+		}
+	}
+	if err := validateMaxSelections(maxSelections, len(choices)); err != nil {
+		w.WriteHeader(422)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// requireAdmin has already checked the credentials.
+	owner, _, _ := r.BasicAuth()
+
+	// Recurring polls share names on purpose, so a duplicate is only
+	// pointed out, when asked, for the admin UI to confirm.
+	var duplicateName bool
+	if r.PostFormValue("warn_on_duplicate_name") == "true" {
+		duplicateName, err = a.PDAL.PollNameTaken(r.Context(), name)
+		if err != nil {
+			log.Printf("in=app.CreatePoll at=PollNameTaken request_id=%s err=%q", requestID(r.Context()), err)
+			w.WriteHeader(500)
+			w.Write([]byte("Internal Server Error"))
+			return
+		}
+	}
+
+	// validatePoll already rejects duplicate answers, so a violation here
+	// is a race or a normalization mismatch and gets the same 422.
+	p, err := a.PDAL.CreatePoll(r.Context(), name, choices, maxSelections, owner)
+	if err == errConstraint {
+		w.WriteHeader(422)
+		w.Write([]byte(errDuplicateAnswer.Error()))
+		return
+	} else if err != nil {
+		log.Printf("in=app.CreatePoll at=CreatePoll request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	if duplicateName {
+		w.Header().Set("Warning", fmt.Sprintf(`299 hidden-polls %q`, "another poll is already named "+name))
+	}
+	w.Header().Set("Location", withBasePath("/?poll_id="+ids.Encode("poll", p.ID)))
+	w.WriteHeader(302)
+}
+
+// CloseAll is the admin panic button: it closes every open poll at once.
+func (a *app) CloseAll(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+
+	if !a.acceptingWrites(w) {
+		return
+	}
+
+	closed, err := a.PDAL.CloseAllPolls(r.Context())
+	if err != nil {
+		log.Printf("in=app.CloseAll at=CloseAllPolls request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	log.Printf("in=app.CloseAll at=closed request_id=%s polls=%d", requestID(r.Context()), closed)
+	a.writeJSON(w, r, 200, struct {
+		Closed int64 `json:"closed"`
+	}{Closed: closed})
+}
+
+// Events lists the event log, newest first, for auditing. limit defaults
+// to 50 and is capped at 500.
+func (a *app) Events(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	limit, offset := 50, 0
+	if raw := r.FormValue("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			a.writeError(w, r, 400, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	if limit > 500 {
+		limit = 500
+	}
+
+	if raw := r.FormValue("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			a.writeError(w, r, 400, "offset must be a non-negative number")
+			return
+		}
+		offset = n
+	}
+
+	events, err := a.PDAL.GetEvents(r.Context(), limit, offset)
+	if err != nil {
+		log.Printf("in=app.Events at=GetEvents request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		Events []*event `json:"events"`
+	}{Events: events})
+}
+
+// EmptyPolls lists polls nobody has voted in that were created longer ago
+// than older_than, a duration defaulting to 30 days, as candidates for
+// cleaning up.
+func (a *app) EmptyPolls(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	olderThan := 30 * 24 * time.Hour
+	if raw := r.FormValue("older_than"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			a.writeError(w, r, 400, "older_than must be a non-negative duration")
+			return
+		}
+		olderThan = d
+	}
+
+	polls, err := a.PDAL.GetEmptyPolls(r.Context(), olderThan)
+	if err != nil {
+		log.Printf("in=app.EmptyPolls at=GetEmptyPolls request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		OlderThan string  `json:"older_than"`
+		Polls     []*poll `json:"polls"`
+	}{OlderThan: olderThan.String(), Polls: polls})
+}
+
+// Ballots exports the votes cast in the poll given by poll_id as CSV, one
+// row per ballot, for verifying results externally. Voters appear as
+// tokens derived from their voter key, consistent within the poll but not
+// across polls, so neither their cookie nor their IP can be recovered.
+func (a *app) Ballots(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	ballots, err := a.PDAL.GetBallots(r.Context(), pollId)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.Ballots at=GetBallots request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	var buffer bytes.Buffer
+	cw := csv.NewWriter(&buffer)
+
+	cw.Write([]string{"voter", "choices", "voted_at"})
+	for _, b := range ballots {
+		var token string
+		if b.VoterID != "" {
+			token = voters.mac("ballot:" + strconv.FormatInt(pollId, 10) + ":" + b.VoterID)[:16]
+		}
+
+		choices := make([]string, 0, len(b.ChoiceIDs))
+		for _, id := range b.ChoiceIDs {
+			choices = append(choices, ids.Encode("choice", id))
+		}
+
+		cw.Write([]string{token, strings.Join(choices, " "), b.CreatedAt.UTC().Format(time.RFC3339)})
+	}
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		log.Printf("in=app.Ballots at=Flush request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"poll-%s-ballots.csv\"", ids.Encode("poll", pollId)))
+	w.Write(buffer.Bytes())
+}
+
+// Close stops the poll given by poll_id accepting votes.
+func (a *app) Close(w http.ResponseWriter, r *http.Request) {
+	a.setOpen(w, r, false)
+}
+
+// Open reopens the poll given by poll_id for voting.
+func (a *app) Open(w http.ResponseWriter, r *http.Request) {
+	a.setOpen(w, r, true)
+}
+
+func (a *app) setOpen(w http.ResponseWriter, r *http.Request, open bool) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	if !a.acceptingWrites(w) {
+		return
+	}
+
+	err = a.PDAL.SetOpen(r.Context(), pollId, open)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.setOpen at=SetOpen request_id=%s open=%t err=%q", requestID(r.Context()), open, err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID string `json:"poll_id"`
+		IsOpen bool   `json:"is_open"`
+	}{PollID: ids.Encode("poll", pollId), IsOpen: open})
+}
+
+// Rename gives the poll given by poll_id a new name.
+func (a *app) Rename(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	name, err := validatePollName(r.PostFormValue("name"))
+	if err != nil {
+		w.WriteHeader(422)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if !a.acceptingWrites(w) {
+		return
+	}
+
+	err = a.PDAL.RenamePoll(r.Context(), pollId, name)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err == errConstraint {
+		w.WriteHeader(409)
+		w.Write([]byte("Conflict"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.Rename at=RenamePoll request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID string `json:"poll_id"`
+		Name   string `json:"name"`
+	}{PollID: ids.Encode("poll", pollId), Name: name})
+}
+
+// UpdateChoice replaces the answer text of the choice given by choice_id.
+func (a *app) UpdateChoice(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+
+	choiceId, err := ids.Decode("choice", r.FormValue("choice_id"))
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid choice_id")
+		return
+	}
+
+	answer, err := validateAnswer(r.PostFormValue("answer"))
+	if err != nil {
+		w.WriteHeader(422)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if !a.acceptingWrites(w) {
+		return
+	}
+
+	err = a.PDAL.UpdateChoice(r.Context(), choiceId, answer)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err == errConstraint {
+		w.WriteHeader(422)
+		w.Write([]byte(errDuplicateAnswer.Error()))
+		return
+	} else if err != nil {
+		log.Printf("in=app.UpdateChoice at=UpdateChoice request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		ChoiceID string `json:"choice_id"`
+		Answer   string `json:"answer"`
+	}{ChoiceID: ids.Encode("choice", choiceId), Answer: answer})
+}
+
+// AddChoice adds a choice answering answer to the poll given by poll_id.
+func (a *app) AddChoice(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	answer, err := validateAnswer(r.PostFormValue("answer"))
+	if err != nil {
+		w.WriteHeader(422)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if !a.acceptingWrites(w) {
+		return
+	}
+
+	c, err := a.PDAL.AddChoice(r.Context(), pollId, answer)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err == errConstraint {
+		w.WriteHeader(422)
+		w.Write([]byte(errDuplicateAnswer.Error()))
+		return
+	} else if err != nil {
+		log.Printf("in=app.AddChoice at=AddChoice request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 201, c)
+}
+
+// Delete removes the poll given by poll_id and everything recorded about
+// it.
+func (a *app) Delete(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	if !a.acceptingWrites(w) {
+		return
+	}
+
+	err = a.PDAL.DeletePoll(r.Context(), pollId)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.Delete at=DeletePoll request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// Pause stops the poll given by poll_id accepting votes until resumed.
+func (a *app) Pause(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, true)
+}
+
+// Resume lets the poll given by poll_id accept votes again.
+func (a *app) Resume(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, false)
+}
+
+func (a *app) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	if !a.acceptingWrites(w) {
+		return
+	}
+
+	if paused {
+		err = a.PDAL.PausePoll(r.Context(), pollId)
+	} else {
+		err = a.PDAL.ResumePoll(r.Context(), pollId)
+	}
+
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.setPaused at=setPaused request_id=%s paused=%t err=%q", requestID(r.Context()), paused, err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID string `json:"poll_id"`
+		Paused bool   `json:"paused"`
+	}{PollID: ids.Encode("poll", pollId), Paused: paused})
+}
+
+func (a *app) ResultsByRegion(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	if !a.checkResultsVisible(w, r, pollId) {
+		return
+	}
+
+	regions, err := a.PDAL.GetResultsByRegion(r.Context(), pollId)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.ResultsByRegion at=GetResultsByRegion request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID  string          `json:"poll_id"`
+		Regions []*regionResult `json:"regions"`
+	}{PollID: ids.Encode("poll", pollId), Regions: regions})
+}
+
+func (a *app) MarginTimeline(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	bucket := time.Hour
+	if raw := r.FormValue("bucket"); raw != "" {
+		bucket, err = time.ParseDuration(raw)
+		if err != nil || bucket < time.Second {
+			a.writeError(w, r, 400, "bucket must be a duration of at least 1s")
+			return
+		}
+	}
+
+	if !a.checkResultsVisible(w, r, pollId) {
+		return
+	}
+
+	points, err := a.PDAL.GetMarginTimeline(r.Context(), pollId, bucket)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.MarginTimeline at=GetMarginTimeline request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID string         `json:"poll_id"`
+		Bucket string         `json:"bucket"`
+		Points []*marginPoint `json:"points"`
+	}{PollID: ids.Encode("poll", pollId), Bucket: bucket.String(), Points: points})
+}
+
+// timelineBuckets are the bucket sizes VoteTimeline accepts.
+var timelineBuckets = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// VoteTimeline reports how many votes a poll got per minute, hour or day,
+// for charting.
+func (a *app) VoteTimeline(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	name := r.FormValue("bucket")
+	if name == "" {
+		name = "hour"
+	}
+	bucket, ok := timelineBuckets[name]
+	if !ok {
+		a.writeError(w, r, 400, "bucket must be minute, hour or day")
+		return
+	}
+
+	if !a.checkResultsVisible(w, r, pollId) {
+		return
+	}
+
+	buckets, err := a.PDAL.GetVoteTimeline(r.Context(), pollId, bucket)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.VoteTimeline at=GetVoteTimeline request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID  string            `json:"poll_id"`
+		Bucket  string            `json:"bucket"`
+		Buckets []*timelineBucket `json:"buckets"`
+	}{PollID: ids.Encode("poll", pollId), Bucket: name, Buckets: buckets})
+}
+
+// AnswerTimestamps reports when each vote for the poll given by poll_id
+// landed, per choice, for auditing disputed polls.
+func (a *app) AnswerTimestamps(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	pollId, err := a.getPollID(r)
+	if err != nil {
+		a.writeError(w, r, 400, "missing or invalid poll_id")
+		return
+	}
+
+	timestamps, err := a.PDAL.GetAnswerTimestamps(r.Context(), pollId)
+	if err == notFound {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	} else if err != nil {
+		log.Printf("in=app.AnswerTimestamps at=GetAnswerTimestamps request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	byChoice := make(map[string][]time.Time, len(timestamps))
+	for choiceId, times := range timestamps {
+		byChoice[ids.Encode("choice", choiceId)] = times
+	}
+
+	a.writeJSON(w, r, 200, struct {
+		PollID  string                 `json:"poll_id"`
+		Answers map[string][]time.Time `json:"answers"`
+	}{PollID: ids.Encode("poll", pollId), Answers: byChoice})
+}
+
+func (a *app) Index(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	// The voter cookie identifies the session votes are deduplicated and
+	// CSRF tokens are issued for.
+	voter, err := ensureVoterCookie(w, r)
+	if err != nil {
+		log.Printf("in=app.Index at=ensureVoterCookie request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+
+	// Without a poll_id, show the latest open poll.
+	var p *poll
+	if pollIDParam(r) != "" {
+		pollId, perr := a.getPollID(r)
+		if perr != nil {
+			a.writeError(w, r, 400, "invalid poll_id")
+			return
+		}
+		p, err = a.PDAL.GetByID(r.Context(), pollId)
+	} else if p, err = a.PDAL.GetLatest(r.Context()); err == notFound {
+		switch a.NoOpenPoll {
+		case "recent":
+			p, err = a.PDAL.GetMostRecent(r.Context())
+		case "landing":
+			a.noPolls(w, r)
+			return
+		}
+	}
+
+	if err == notFound {
+		a.writeError(w, r, 404, "Not Found")
+		return
+	} else if err != nil {
+		log.Printf("in=app.Index at=GetPoll request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+
+	cs, truncated, err := a.PDAL.GetChoices(r.Context(), p.ID)
+	if err == notFound {
+		a.writeError(w, r, 404, "Not Found")
+		return
+	} else if err != nil {
+		log.Printf("in=app.Index at=GetChoices request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+
+	// Votes are cast by choice id, so reordering the page is harmless.
+	if p.ShuffleChoices {
+		shuffleChoices(cs, a.shuffleSeed())
+	}
+
+	// Voters who may still change their vote see it pre-selected.
+	selected := make(map[int64]bool)
+	if p.VoteChangeWindow > 0 {
+		prior, err := a.PDAL.GetVoterChoices(r.Context(), p.ID, "c:"+voter)
+		if err != nil {
+			log.Printf("in=app.Index at=GetVoterChoices request_id=%s err=%q", requestID(r.Context()), err)
+			a.writeError(w, r, 500, "Internal Server Error")
+			return
+		}
+		for _, id := range prior {
+			selected[id] = true
+		}
+	}
+
+	tmpl, err := a.template("index")
+	if err != nil {
+		log.Printf("in=app.Index at=template request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, struct {
+		Poll      *poll
+		Choices   []*choice
+		Truncated bool
+		CSRFToken string
+		Selected  map[int64]bool
+	}{Poll: p, Choices: cs, Truncated: truncated, CSRFToken: csrfToken(voter), Selected: selected})
+	if err != nil {
+		log.Printf("in=app.Index at=Execute request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+		return
+	}
+
+	if a.Impressions != nil {
+		a.Impressions.Record(cs)
+	}
+
+	if err := a.layout(w, p.Name, p.Theme, template.HTML(buffer.String())); err != nil {
+		log.Printf("in=app.Index at=layout request_id=%s err=%q", requestID(r.Context()), err)
+		a.writeError(w, r, 500, "Internal Server Error")
+	}
+}
+
+// noPolls renders the landing page shown when there is no poll to vote on.
+func (a *app) noPolls(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := a.template("empty")
+	if err != nil {
+		log.Printf("in=app.noPolls at=template request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, nil)
+	if err != nil {
+		log.Printf("in=app.noPolls at=Execute request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	if err := a.layout(w, "No active polls", "", template.HTML(buffer.String())); err != nil {
+		log.Printf("in=app.noPolls at=layout request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+	}
+}
+
+func (a *app) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("in=app.writeJSON at=Marshal request_id=%s err=%q", requestID(r.Context()), err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// resultsETag returns a weak ETag for res as served in format to r. Besides
+// changing whenever a vote is cast, it covers everything else the response
+// depends on: the representation, the sort, view and all parameters, and
+// the poll and its choices as shown.
+func resultsETag(r *http.Request, res *result, format string) (string, error) {
+	state, err := json.Marshal(res)
 	if err != nil {
-		log.Printf("in=app.layout at=Execute err=%q", err)
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", format, r.FormValue("sort"), r.FormValue("view"), r.FormValue("all"))
+	h.Write(state)
+	return fmt.Sprintf(`W/"%d-%d-%s"`, res.Poll.ID, res.Count, hex.EncodeToString(h.Sum(nil))[:16]), nil
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using
+// weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeError responds with status and message, as {"error": message} to
+// clients that asked for JSON and as plain text to everyone else.
+func (a *app) writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if wantsJSON(r) {
+		a.writeJSON(w, r, status, map[string]string{"error": message})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
+
+// wantsJSON reports whether r is for the JSON API, posted JSON, or prefers
+// JSON to text and HTML.
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") || isJSON(r) {
+		return true
+	}
+	return negotiate(r, "text/plain", "text/html", "application/json") == "application/json"
+}
+
+// writeCSV writes one row per summary of res, preceded by a header row.
+func (a *app) writeCSV(w http.ResponseWriter, r *http.Request, res *result) {
+	var buffer bytes.Buffer
+	cw := csv.NewWriter(&buffer)
+
+	cw.Write([]string{"answer", "votes", "percentage"})
+	for _, row := range res.Flatten() {
+		cw.Write([]string{
+			row.Answer,
+			strconv.FormatInt(row.Count, 10),
+			strconv.FormatFloat(row.Percentage, 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		log.Printf("in=app.writeCSV at=Flush request_id=%s err=%q", requestID(r.Context()), err)
 		w.WriteHeader(500)
 		w.Write([]byte("Internal Server Error"))
 		return
 	}
 
+	w.Header().Set("Content-Type", "text/csv")
+	w.Write(buffer.Bytes())
+}
+
+// allowMethods answers OPTIONS with 204 and any method not in allowed with
+// 405, advertising allowed in the Allow header. It reports whether the
+// handler should carry on serving the request.
+func allowMethods(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, m := range allowed {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return false
+	}
+
+	w.WriteHeader(405)
+	w.Write([]byte("Method Not Allowed"))
+	return false
+}
+
+// template returns the named template, re-reading it from TemplatesDir
+// when live reload is enabled. Templates missing from TemplatesDir are the
+// built-in ones, as with loadTemplates.
+func (a *app) template(name string) (*template.Template, error) {
+	if a.TemplateReload && a.TemplatesDir != "" {
+		t, err := parseTemplateFile(a.TemplatesDir, name)
+		if !os.IsNotExist(err) {
+			return t, err
+		}
+	}
+
+	switch name {
+	case "layout":
+		return layoutTmpl, nil
+	case "results":
+		return resultsTmpl, nil
+	case "index":
+		return indexTmpl, nil
+	case "empty":
+		return emptyTmpl, nil
+	case "polls":
+		return pollsTmpl, nil
+	case "bars":
+		return barsTmpl, nil
+	case "hidden":
+		return hiddenTmpl, nil
+	}
+	return nil, fmt.Errorf("unknown template %q", name)
+}
+
+func (a *app) getPollID(r *http.Request) (int64, error) {
+	return ids.Decode("poll", pollIDParam(r))
+}
+
+// clientIP returns the address of the client making r, for rate limiting
+// and geolocation. Clients can send any X-Forwarded-For they like, so only
+// its last address, the one the Heroku router appended, is trusted.
+// Without the header, it's the peer address.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// layout wraps body in the layout template and writes the page to w. The
+// page is rendered in full before anything is written, so on error nothing
+// has been sent and the caller can still respond with a clean 500.
+func (a *app) layout(w http.ResponseWriter, title, theme string, body template.HTML) error {
+	tmpl, err := a.template("layout")
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, struct {
+		Body       template.HTML
+		Title      string
+		Stylesheet string
+	}{Body: body, Title: title, Stylesheet: themeStylesheet(theme)})
+	if err != nil {
+		return err
+	}
+
 	w.Write(buffer.Bytes())
+	return nil
 }
 
 func main() {
-	db := openDB(os.Getenv("DATABASE_URL"))
-	dal := newPollDAL(db)
-	a := &app{PDAL: dal}
-
-	http.HandleFunc("/results", a.Results)
-	http.HandleFunc("/answer", a.Answer)
-	http.HandleFunc("/", a.Index)
-	http.ListenAndServe(":"+os.Getenv("PORT"), nil)
-}
-
-const layoutRaw = `
-<!DOCTYPE html>
-<html>
-	<head>
-		<meta charset="UTF-8">
-		<title>{{.Title}}</title>
-    <link rel="stylesheet" href="//www.herokucdn.com/purple/1.0.0/purple.min.css">
-    <script src="//www.herokucdn.com/purple/1.0.0/purple.min.js"></script>
-	</head>
-	<body>
-     <div class="container">
-         <header>
-            <h1>Hidden Polls</h1>
-         </header>
-
-         {{.Body}}
-     </div>
-	</body>
-</html>
-`
-
-const resultsRaw = `
-<div class="row">
-<h2>{{.Poll.Name}}</h2>
-<p><em>{{.Count}} total votes</em></p>
-<ul>
-    {{range $i, $choice := .Summaries}}
-    <li>{{$choice.Answer}}: {{$choice.Count}} votes ({{$choice.Percentage | printf "%.3f"}})</li>
-    {{end}}
-</ul>
-</div>
-`
-
-const indexRaw = `
-<div class="row">
-<h2>{{.Poll.Name}}</h2>
-<form method="POST" action="/answer">
-<input type="hidden" value="{{.Poll.ID}}" name="poll_id" />
-{{range $i, $choice := .Choices}}
-  <p><input name="choice_id" type="radio" value="{{ $choice.ID }}" /> {{$choice.Answer}}</p>
-{{end}}
-<p><input type="submit" value="Vote" /></p>
-</form>
-</div>
-`
+	db, pool := openDB(os.Getenv("DATABASE_URL"))
+
+	timezone := os.Getenv("TIMEZONE")
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		log.Fatalf("Invalid TIMEZONE %q: %q", timezone, err)
+	}
+
+	ids.key = []byte(os.Getenv("ID_SIGNING_KEY"))
+	if len(ids.key) == 0 {
+		log.Printf("in=main at=ids warning=%q", "ID_SIGNING_KEY unset, ids in links won't survive a restart")
+		ids.key = make([]byte, 32)
+		if _, err := rand.Read(ids.key); err != nil {
+			log.Fatalf("Error generating id signing key: %q", err)
+		}
+	}
+
+	voters.key = []byte(os.Getenv("VOTER_COOKIE_SECRET"))
+	if len(voters.key) == 0 {
+		log.Printf("in=main at=voters warning=%q", "VOTER_COOKIE_SECRET unset, voter cookies won't survive a restart")
+		voters.key = make([]byte, 32)
+		if _, err := rand.Read(voters.key); err != nil {
+			log.Fatalf("Error generating voter cookie secret: %q", err)
+		}
+	}
+
+	maxChoices := 1000
+	if raw := os.Getenv("MAX_CHOICES"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid MAX_CHOICES %q", raw)
+		}
+		maxChoices = n
+	}
+
+	runMigrationsAtBoot := os.Getenv("RUN_MIGRATIONS") == "true"
+	if runMigrationsAtBoot {
+		if err := runMigrations(context.Background(), db, postgresDialect{}); err != nil {
+			log.Fatalf("Error running migrations: %q", err)
+		}
+	}
+
+	queryTimeout := envDuration("DB_QUERY_TIMEOUT", 10*time.Second)
+
+	dal := newPollDAL(db, postgresDialect{}, timezone, maxChoices, queryTimeout)
+	a := &app{
+		PDAL:           dal,
+		TemplatesDir:   os.Getenv("TEMPLATES_DIR"),
+		TemplateReload: os.Getenv("TEMPLATE_RELOAD") == "true",
+		ReadOnly:       os.Getenv("READ_ONLY") == "true",
+		NoOpenPoll:     os.Getenv("NO_OPEN_POLL"),
+		Geo:            noopGeolocator{},
+		AdminUser:      os.Getenv("ADMIN_USER"),
+		AdminPass:      os.Getenv("ADMIN_PASS"),
+		Limits: map[string]int64{
+			"max_choices": int64(maxChoices),
+		},
+	}
+
+	switch a.NoOpenPoll {
+	case "":
+		a.NoOpenPoll = "landing"
+	case "notfound", "recent", "landing":
+	default:
+		log.Fatalf("Invalid NO_OPEN_POLL %q: must be notfound, recent or landing", a.NoOpenPoll)
+	}
+
+	a.MaxRenderedResults = 50
+	if raw := os.Getenv("RESULTS_MAX_RENDERED"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			log.Fatalf("Invalid RESULTS_MAX_RENDERED %q: %q", raw, err)
+		}
+		a.MaxRenderedResults = n
+	}
+
+	logLevel := os.Getenv("LOG_REQUESTS")
+	switch logLevel {
+	case "":
+		logLevel = "all"
+	case "all", "errors", "off":
+	default:
+		log.Fatalf("Invalid LOG_REQUESTS %q: must be all, errors or off", logLevel)
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		log.Fatalf("Invalid PORT %q: must be a number from 0 to 65535", port)
+	}
+	addr := net.JoinHostPort(os.Getenv("HOST"), port)
+
+	basePath = normalizeBasePath(os.Getenv("BASE_PATH"))
+
+	metricsEnabled := os.Getenv("METRICS_ENABLED") == "true"
+
+	// Zero turns rate limiting off.
+	rateLimit := envInt("RATE_LIMIT_PER_MINUTE", 30)
+	a.Limits["rate_limit_per_minute"] = int64(rateLimit)
+
+	delay := drainDelay()
+	timeout := shutdownTimeout()
+	a.Config = map[string]string{
+		"DATABASE_URL":          os.Getenv("DATABASE_URL"),
+		"DB_MAX_IDLE_CONNS":     strconv.Itoa(pool.MaxIdleConns),
+		"DB_MAX_OPEN_CONNS":     strconv.Itoa(pool.MaxOpenConns),
+		"DB_CONN_MAX_LIFETIME":  pool.ConnMaxLifetime.String(),
+		"DB_QUERY_TIMEOUT":      queryTimeout.String(),
+		"RUN_MIGRATIONS":        strconv.FormatBool(runMigrationsAtBoot),
+		"DB_CONNECT_RETRIES":    strconv.Itoa(pool.ConnectRetries),
+		"DB_CONNECT_BACKOFF":    pool.ConnectBackoff.String(),
+		"TIMEZONE":              timezone,
+		"TEMPLATES_DIR":         a.TemplatesDir,
+		"TEMPLATE_RELOAD":       strconv.FormatBool(a.TemplateReload),
+		"IMPRESSIONS_ENABLED":   strconv.FormatBool(os.Getenv("IMPRESSIONS_ENABLED") == "true"),
+		"DRAIN_DELAY":           delay.String(),
+		"SHUTDOWN_TIMEOUT":      timeout.String(),
+		"RESULTS_MAX_RENDERED":  strconv.Itoa(a.MaxRenderedResults),
+		"READ_ONLY":             strconv.FormatBool(a.ReadOnly),
+		"NO_OPEN_POLL":          a.NoOpenPoll,
+		"MAX_CHOICES":           strconv.Itoa(maxChoices),
+		"ID_SIGNING_KEY":        os.Getenv("ID_SIGNING_KEY"),
+		"VOTER_COOKIE_SECRET":   os.Getenv("VOTER_COOKIE_SECRET"),
+		"HOST":                  os.Getenv("HOST"),
+		"PORT":                  port,
+		"LOG_REQUESTS":          logLevel,
+		"METRICS_ENABLED":       strconv.FormatBool(metricsEnabled),
+		"ADMIN_USER":            a.AdminUser,
+		"ADMIN_PASS":            a.AdminPass,
+		"RATE_LIMIT_PER_MINUTE": strconv.Itoa(rateLimit),
+		"BASE_PATH":             basePath,
+	}
+
+	if os.Getenv("IMPRESSIONS_ENABLED") == "true" {
+		a.Impressions = newImpressionLogger(dal, 10000, 10*time.Second)
+		go a.Impressions.Run()
+	}
+
+	go reconcileVoteCounts(dal, time.Hour)
+	go refreshResultCaches(dal, time.Minute)
+	go closeExpiredPolls(dal, time.Minute)
+
+	if a.TemplatesDir != "" && !a.TemplateReload {
+		if err := loadTemplates(a.TemplatesDir); err != nil {
+			log.Fatalf("Error loading templates from %s: %q", a.TemplatesDir, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/results", a.Results)
+	mux.HandleFunc("/results.png", a.ResultsPNG)
+	mux.HandleFunc("/results.csv", a.Results)
+	answer := a.Answer
+	if rateLimit > 0 {
+		limiter := newRateLimiter(rateLimit, time.Minute)
+		go limiter.Run(time.Minute)
+		answer = limiter.Limit(answer)
+	}
+	mux.HandleFunc("/answer", answer)
+	mux.HandleFunc("/polls", a.Polls)
+	mux.HandleFunc("/polls/", a.PollRoutes)
+	mux.HandleFunc("/polls/close", a.requireAdmin(a.Close))
+	mux.HandleFunc("/polls/open", a.requireAdmin(a.Open))
+	mux.HandleFunc("/polls/delete", a.requireAdmin(a.Delete))
+	mux.HandleFunc("/polls/rename", a.requireAdmin(a.Rename))
+	mux.HandleFunc("/polls/choices", a.requireAdmin(a.AddChoice))
+	mux.HandleFunc("/choices/update", a.requireAdmin(a.UpdateChoice))
+	mux.HandleFunc("/polls/pause", a.requireAdmin(a.Pause))
+	mux.HandleFunc("/polls/resume", a.requireAdmin(a.Resume))
+	mux.HandleFunc("/api/results", a.Results)
+	mux.HandleFunc("/api/hourly", a.Hourly)
+	mux.HandleFunc("/api/results/delta", a.ResultsDelta)
+	mux.HandleFunc("/api/results/regions", a.ResultsByRegion)
+	mux.HandleFunc("/api/margin", a.MarginTimeline)
+	mux.HandleFunc("/api/timeline", a.VoteTimeline)
+	mux.HandleFunc("/api/answers", a.requireAdmin(a.AnswerTimestamps))
+	mux.HandleFunc("/admin/close-all", a.requireAdmin(a.CloseAll))
+	mux.HandleFunc("/admin/events", a.requireAdmin(a.Events))
+	mux.HandleFunc("/admin/empty-polls", a.requireAdmin(a.EmptyPolls))
+	mux.HandleFunc("/admin/ballots", a.requireAdmin(a.Ballots))
+	mux.HandleFunc("/api/info", a.Info)
+	mux.HandleFunc("/healthz", a.Health)
+	mux.HandleFunc("/api/ctr", a.CTR)
+	mux.HandleFunc("/themes/", a.Theme)
+	mux.Handle("/static/", staticHandler())
+	mux.HandleFunc("/", a.Index)
+
+	if os.Getenv("DEBUG_CONFIG") == "true" {
+		mux.HandleFunc("/debug/config", a.requireAdmin(a.DebugConfig))
+	}
+
+	var m *metrics
+	if metricsEnabled {
+		m = newMetrics(db.Stats)
+		mux.Handle("/metrics", m)
+	}
+
+	mws := []middleware{recoverPanics}
+	if logLevel != "off" || m != nil {
+		// Outside recovery, so recovered panics are logged as 500s.
+		mws = append([]middleware{logRequests(logLevel, mux, m)}, mws...)
+	}
+	// Outermost, so everything else sees paths as the mux does and every
+	// log line carries the request id.
+	mws = append([]middleware{stripBasePath, withRequestID}, mws...)
+	handler := chain(mux, mws...)
+
+	log.Printf("in=main at=listen addr=%s", addr)
+	server := &http.Server{Addr: addr, Handler: handler}
+	stopped := make(chan struct{})
+	go func() {
+		shutdownOnSignal(a, server, delay, timeout)
+		close(stopped)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf("Error serving: %q", err)
+	}
+
+	<-stopped
+	if err := db.Close(); err != nil {
+		log.Printf("in=main at=db.Close err=%q", err)
+	}
+	log.Printf("in=main at=shutdown status=complete")
+}
+
+// reconcileVoteCounts periodically repairs any drift in the denormalized
+// per-poll vote counts.
+func reconcileVoteCounts(dal pollDALer, interval time.Duration) {
+	for range time.Tick(interval) {
+		fixed, err := dal.ReconcileVoteCounts(context.Background())
+		if err != nil {
+			log.Printf("in=reconcileVoteCounts at=ReconcileVoteCounts err=%q", err)
+			continue
+		}
+		if fixed > 0 {
+			log.Printf("in=reconcileVoteCounts at=fixed polls=%d", fixed)
+		}
+	}
+}
+
+// refreshResultCaches periodically recomputes the cached results of polls
+// flagged with cache_results.
+func refreshResultCaches(dal pollDALer, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := dal.RefreshResultCaches(context.Background()); err != nil {
+			log.Printf("in=refreshResultCaches at=RefreshResultCaches err=%q", err)
+		}
+	}
+}
+
+// closeExpiredPolls periodically closes polls whose close_at has passed.
+func closeExpiredPolls(dal pollDALer, interval time.Duration) {
+	for range time.Tick(interval) {
+		closed, err := dal.CloseExpiredPolls(context.Background())
+		if err != nil {
+			log.Printf("in=closeExpiredPolls at=CloseExpiredPolls err=%q", err)
+			continue
+		}
+		if closed > 0 {
+			log.Printf("in=closeExpiredPolls at=closed polls=%d", closed)
+		}
+	}
+}
+
+// drainDelay is how long votes are refused before the process exits,
+// from DRAIN_DELAY (a time.Duration string), defaulting to 5 seconds.
+func drainDelay() time.Duration {
+	delay := 5 * time.Second
+	if raw := os.Getenv("DRAIN_DELAY"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			log.Printf("in=drainDelay at=ParseDuration value=%q err=%q", raw, err)
+			return delay
+		}
+		delay = d
+	}
+	return delay
+}
+
+// shutdownTimeout is how long in-flight requests get to finish once the
+// server starts shutting down.
+func shutdownTimeout() time.Duration {
+	timeout := 15 * time.Second
+	if raw := os.Getenv("SHUTDOWN_TIMEOUT"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			log.Printf("in=shutdownTimeout at=ParseDuration value=%q err=%q", raw, err)
+			return timeout
+		}
+		timeout = d
+	}
+	return timeout
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then stops accepting votes,
+// waits delay for the router to notice and shuts server down, giving
+// in-flight requests up to timeout to finish.
+func shutdownOnSignal(a *app, server *http.Server, delay, timeout time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+
+	log.Printf("in=main at=drain signal=%q delay=%s", sig, delay)
+	a.SetDraining(true)
+	time.Sleep(delay)
+
+	log.Printf("in=main at=shutdown status=begin timeout=%s", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("in=main at=shutdown err=%q", err)
+	}
+}
+
+// formatPercentage renders a fraction like 0.333 as "33.3%". Anything that
+// isn't a number, as a poll without votes could produce, shows as "0.0%".
+func formatPercentage(f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		f = 0
+	}
+	return strconv.FormatFloat(f*100, 'f', 1, 64) + "%"
+}
+
+// barWidth is the CSS width of a bar standing for a fraction of the votes,
+// clamped to between 0 and 100%.
+func barWidth(f float64) template.CSS {
+	if math.IsNaN(f) || f < 0 {
+		f = 0
+	} else if f > 1 {
+		f = 1
+	}
+	return template.CSS("width: " + strconv.FormatFloat(f*100, 'f', 1, 64) + "%")
+}
+
+// templateFuncs are available to every template.
+var templateFuncs = template.FuncMap{
+	"pollID": func(id int64) string {
+		return ids.Encode("poll", id)
+	},
+	"choiceID": func(id int64) string {
+		return ids.Encode("choice", id)
+	},
+	"pct":      formatPercentage,
+	"barWidth": barWidth,
+	"path":     withBasePath,
+}
 
 var layoutTmpl *template.Template
 var resultsTmpl *template.Template
 var indexTmpl *template.Template
+var emptyTmpl *template.Template
+var pollsTmpl *template.Template
+var barsTmpl *template.Template
+var hiddenTmpl *template.Template
+
+// parseTemplateFile parses dir/<name>.html as the template called name.
+func parseTemplateFile(dir, name string) (*template.Template, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, name+".html"))
+	if err != nil {
+		return nil, err
+	}
+	return template.New(name).Funcs(templateFuncs).Parse(string(raw))
+}
+
+// loadTemplates replaces the built-in templates with those found in dir.
+// Templates missing from dir keep their built-in definition.
+func loadTemplates(dir string) error {
+	for name, t := range map[string]**template.Template{
+		"layout":  &layoutTmpl,
+		"results": &resultsTmpl,
+		"index":   &indexTmpl,
+		"empty":   &emptyTmpl,
+		"polls":   &pollsTmpl,
+		"bars":    &barsTmpl,
+		"hidden":  &hiddenTmpl,
+	} {
+		parsed, err := parseTemplateFile(dir, name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		*t = parsed
+	}
+	return nil
+}
+
+// builtinTemplates holds the templates compiled into the binary.
+//
+//go:embed templates/*.html
+var builtinTemplates embed.FS
+
+// parseBuiltinTemplate parses templates/<name>.html from builtinTemplates.
+func parseBuiltinTemplate(name string) *template.Template {
+	return template.Must(template.New(name+".html").Funcs(templateFuncs).ParseFS(builtinTemplates, "templates/"+name+".html"))
+}
 
 func init() {
-	layoutTmpl = template.Must(template.New("layout").Parse(layoutRaw))
-	resultsTmpl = template.Must(template.New("results").Parse(resultsRaw))
-	indexTmpl = template.Must(template.New("index").Parse(indexRaw))
+	layoutTmpl = parseBuiltinTemplate("layout")
+	resultsTmpl = parseBuiltinTemplate("results")
+	indexTmpl = parseBuiltinTemplate("index")
+	emptyTmpl = parseBuiltinTemplate("empty")
+	pollsTmpl = parseBuiltinTemplate("polls")
+	barsTmpl = parseBuiltinTemplate("bars")
+	hiddenTmpl = parseBuiltinTemplate("hidden")
 }
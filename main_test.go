@@ -0,0 +1,2241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestApp returns an app backed by an in-memory DAL, with admin
+// credentials "admin" and "secret".
+func newTestApp(t *testing.T) (*app, *inMemoryDAL) {
+	t.Helper()
+
+	dal := newInMemoryDAL("UTC", 1000)
+	a := &app{
+		PDAL:       dal,
+		NoOpenPoll: "landing",
+		Geo:        noopGeolocator{},
+		AdminUser:  "admin",
+		AdminPass:  "secret",
+	}
+	return a, dal
+}
+
+// createTestPoll creates an open poll named name with the given choices.
+func createTestPoll(t *testing.T, dal *inMemoryDAL, name string, choices ...string) (*poll, []*choice) {
+	t.Helper()
+
+	p, err := dal.CreatePoll(context.Background(), name, choices, 1, "admin")
+	if err != nil {
+		t.Fatalf("CreatePoll: %v", err)
+	}
+	cs, _, err := dal.GetChoices(context.Background(), p.ID)
+	if err != nil {
+		t.Fatalf("GetChoices: %v", err)
+	}
+	return p, cs
+}
+
+// voterCookieFor returns a valid voter cookie and the CSRF token issued
+// with it.
+func voterCookieFor(t *testing.T) (*http.Cookie, string) {
+	t.Helper()
+
+	value, err := voters.Issue()
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	token, _ := voters.Verify(value)
+	return &http.Cookie{Name: voterCookie, Value: value}, csrfToken(token)
+}
+
+func TestIndexShowsLatestPoll(t *testing.T) {
+	a, dal := newTestApp(t)
+	createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+
+	w := httptest.NewRecorder()
+	a.Index(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	for _, want := range []string{"Best colour?", "Red", "Blue", csrfField} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body missing %q", want)
+		}
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Errorf("no voter cookie issued")
+	}
+}
+
+func TestIndexWithoutPolls(t *testing.T) {
+	a, _ := newTestApp(t)
+
+	w := httptest.NewRecorder()
+	a.Index(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Fatalf("landing status = %d, want 200", w.Code)
+	}
+
+	a.NoOpenPoll = "notfound"
+	w = httptest.NewRecorder()
+	a.Index(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 404 {
+		t.Fatalf("notfound status = %d, want 404", w.Code)
+	}
+}
+
+func TestResults(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	if err := dal.Answer(context.Background(), p.ID, []int64{cs[1].ID}, "c:one", ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+
+	target := "/api/results?poll_id=" + strconv.FormatInt(p.ID, 10)
+	w := httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", target, nil))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+
+	var res struct {
+		Count     int64 `json:"count"`
+		Summaries []struct {
+			Answer string `json:"answer"`
+			Count  int64  `json:"count"`
+		} `json:"summaries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if res.Count != 1 {
+		t.Errorf("count = %d, want 1", res.Count)
+	}
+	for _, s := range res.Summaries {
+		if s.Answer == "Blue" && s.Count != 1 {
+			t.Errorf("Blue count = %d, want 1", s.Count)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/results?poll_id=999", nil))
+	if w.Code != 404 {
+		t.Errorf("unknown poll status = %d, want 404", w.Code)
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	cookie, csrf := voterCookieFor(t)
+
+	vote := func(token string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"poll_id":   {strconv.FormatInt(p.ID, 10)},
+			"choice_id": {strconv.FormatInt(cs[0].ID, 10)},
+			csrfField:   {token},
+		}
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		a.Answer(w, r)
+		return w
+	}
+
+	if w := vote("bogus"); w.Code != 403 {
+		t.Fatalf("bad CSRF token status = %d, want 403", w.Code)
+	}
+
+	w := vote(csrf)
+	if w.Code != 302 {
+		t.Fatalf("status = %d, want 302; body %q", w.Code, w.Body.String())
+	}
+	if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, "/results?poll_id=") {
+		t.Errorf("Location = %q", loc)
+	}
+
+	if w := vote(csrf); w.Code != 409 {
+		t.Errorf("second vote status = %d, want 409", w.Code)
+	}
+
+	res, err := dal.GetResults(context.Background(), p.ID, byVotes)
+	if err != nil {
+		t.Fatalf("GetResults: %v", err)
+	}
+	if res.Count != 1 {
+		t.Errorf("count = %d, want 1", res.Count)
+	}
+}
+
+func TestCreatePoll(t *testing.T) {
+	a, dal := newTestApp(t)
+	handler := a.requireAdmin(a.CreatePoll)
+
+	create := func(form url.Values, auth bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/polls", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if auth {
+			r.SetBasicAuth("admin", "secret")
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	form := url.Values{"name": {"Lunch?"}, "choice": {"Pizza", "Tacos"}}
+	if w := create(form, false); w.Code != 401 {
+		t.Fatalf("unauthenticated status = %d, want 401", w.Code)
+	}
+
+	w := create(form, true)
+	if w.Code != 302 {
+		t.Fatalf("status = %d, want 302; body %q", w.Code, w.Body.String())
+	}
+
+	p, err := dal.GetLatest(context.Background())
+	if err != nil {
+		t.Fatalf("GetLatest: %v", err)
+	}
+	if p.Name != "Lunch?" || p.Owner != "admin" {
+		t.Errorf("poll = %q by %q, want \"Lunch?\" by \"admin\"", p.Name, p.Owner)
+	}
+
+	if w := create(url.Values{"name": {"Lunch?"}, "choice": {"Pizza"}}, true); w.Code != 422 {
+		t.Errorf("one choice status = %d, want 422", w.Code)
+	}
+}
+
+// adminPost posts form to handler, wrapped in requireAdmin, as the admin.
+func adminPost(a *app, handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("admin", "secret")
+
+	w := httptest.NewRecorder()
+	a.requireAdmin(handler)(w, r)
+	return w
+}
+
+func TestAddChoice(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, _ := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	pollID := strconv.FormatInt(p.ID, 10)
+
+	w := adminPost(a, a.AddChoice, "/polls/choices", url.Values{"poll_id": {pollID}, "answer": {"Green"}})
+	if w.Code != 201 {
+		t.Fatalf("status = %d, want 201; body %q", w.Code, w.Body.String())
+	}
+
+	cs, _, err := dal.GetChoices(context.Background(), p.ID)
+	if err != nil {
+		t.Fatalf("GetChoices: %v", err)
+	}
+	if len(cs) != 3 || cs[2].Answer != "Green" {
+		t.Fatalf("choices = %v, want Green added", cs)
+	}
+
+	for _, dup := range []string{"Green", "  green ", "BLUE"} {
+		w := adminPost(a, a.AddChoice, "/polls/choices", url.Values{"poll_id": {pollID}, "answer": {dup}})
+		if w.Code != 422 || w.Body.String() != errDuplicateAnswer.Error() {
+			t.Errorf("adding %q: status = %d, body %q; want 422 %q", dup, w.Code, w.Body.String(), errDuplicateAnswer)
+		}
+	}
+}
+
+func TestUpdateChoiceDuplicate(t *testing.T) {
+	a, dal := newTestApp(t)
+	_, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	choiceID := strconv.FormatInt(cs[0].ID, 10)
+
+	w := adminPost(a, a.UpdateChoice, "/choices/update", url.Values{"choice_id": {choiceID}, "answer": {"blue"}})
+	if w.Code != 422 {
+		t.Errorf("duplicate status = %d, want 422", w.Code)
+	}
+
+	// A choice may change the case of its own answer.
+	w = adminPost(a, a.UpdateChoice, "/choices/update", url.Values{"choice_id": {choiceID}, "answer": {"RED"}})
+	if w.Code != 200 {
+		t.Errorf("recase status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+}
+
+func TestIndexTruncatesChoicesOverCap(t *testing.T) {
+	a, dal := newTestApp(t)
+	dal.maxChoices = 2
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue", "Green")
+
+	if len(cs) != 2 {
+		t.Fatalf("GetChoices returned %d choices, want 2", len(cs))
+	}
+	if _, truncated, _ := dal.GetChoices(context.Background(), p.ID); !truncated {
+		t.Errorf("GetChoices didn't flag the truncation")
+	}
+
+	w := httptest.NewRecorder()
+	a.Index(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "too many choices") {
+		t.Errorf("body doesn't mention the truncation")
+	}
+	if strings.Contains(body, "Green") {
+		t.Errorf("body lists a choice past the cap")
+	}
+
+	cookie, csrf := voterCookieFor(t)
+	form := url.Values{
+		"poll_id": {strconv.FormatInt(p.ID, 10)},
+		"answer":  {"Green"},
+		csrfField: {csrf},
+	}
+	r := httptest.NewRequest("POST", "/answer", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	a.Answer(w, r)
+	if w.Code != 422 {
+		t.Errorf("vote by text status = %d, want 422", w.Code)
+	}
+}
+
+func TestMutationsAppendOneEvent(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	cookie, csrf := voterCookieFor(t)
+	pollID := strconv.FormatInt(p.ID, 10)
+
+	events := func() []*event {
+		t.Helper()
+		es, err := dal.GetEvents(context.Background(), 100, 0)
+		if err != nil {
+			t.Fatalf("GetEvents: %v", err)
+		}
+		return es
+	}
+	// appended runs mutate and returns the kinds of the events it added.
+	appended := func(mutate func()) []string {
+		before := len(events())
+		mutate()
+		after := events()
+		var kinds []string
+		for _, e := range after[:len(after)-before] {
+			kinds = append(kinds, e.Kind)
+		}
+		return kinds
+	}
+
+	vote := func() {
+		form := url.Values{"poll_id": {pollID}, "choice_id": {strconv.FormatInt(cs[0].ID, 10)}, csrfField: {csrf}}
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		a.Answer(httptest.NewRecorder(), r)
+	}
+
+	if kinds := appended(vote); len(kinds) != 1 || kinds[0] != "vote_cast" {
+		t.Errorf("vote appended %v, want [vote_cast]", kinds)
+	}
+	// A rejected vote changes nothing, so it logs nothing either.
+	if kinds := appended(vote); len(kinds) != 0 {
+		t.Errorf("repeat vote appended %v, want none", kinds)
+	}
+
+	closePoll := func() {
+		adminPost(a, a.Close, "/polls/close", url.Values{"poll_id": {pollID}})
+	}
+	if kinds := appended(closePoll); len(kinds) != 1 || kinds[0] != "poll_closed" {
+		t.Errorf("close appended %v, want [poll_closed]", kinds)
+	}
+
+	r := httptest.NewRequest("GET", "/admin/events?limit=2", nil)
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	a.requireAdmin(a.Events)(w, r)
+	if w.Code != 200 {
+		t.Fatalf("events status = %d, want 200", w.Code)
+	}
+
+	var body struct {
+		Events []struct {
+			Kind string `json:"kind"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(body.Events) != 2 || body.Events[0].Kind != "poll_closed" || body.Events[1].Kind != "vote_cast" {
+		t.Errorf("events = %+v, want poll_closed then vote_cast", body.Events)
+	}
+}
+
+func TestEmptyPolls(t *testing.T) {
+	a, dal := newTestApp(t)
+
+	now := time.Now().UTC()
+	dal.now = func() time.Time { return now.AddDate(0, 0, -60) }
+	oldEmpty, _ := createTestPoll(t, dal, "Old and empty", "Yes", "No")
+	oldVoted, cs := createTestPoll(t, dal, "Old with votes", "Yes", "No")
+	if err := dal.Answer(context.Background(), oldVoted.ID, []int64{cs[0].ID}, "c:one", ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+	dal.now = func() time.Time { return now }
+	createTestPoll(t, dal, "Recent and empty", "Yes", "No")
+
+	r := httptest.NewRequest("GET", "/admin/empty-polls?older_than=720h", nil)
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	a.requireAdmin(a.EmptyPolls)(w, r)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+
+	var body struct {
+		Polls []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"polls"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(body.Polls) != 1 || body.Polls[0].ID != ids.Encode("poll", oldEmpty.ID) {
+		t.Errorf("polls = %+v, want only %q", body.Polls, oldEmpty.Name)
+	}
+
+	r = httptest.NewRequest("GET", "/admin/empty-polls?older_than=soon", nil)
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	a.requireAdmin(a.EmptyPolls)(w, r)
+	if w.Code != 400 {
+		t.Errorf("bad older_than status = %d, want 400", w.Code)
+	}
+}
+
+func TestExpectRows(t *testing.T) {
+	tests := []struct {
+		affected int64
+		want     error
+	}{
+		{1, nil},
+		{0, notFound},
+		{2, errUnexpectedRows},
+	}
+
+	for _, tt := range tests {
+		if err := expectRows(driver.RowsAffected(tt.affected), 1); err != tt.want {
+			t.Errorf("expectRows(%d, 1) = %v, want %v", tt.affected, err, tt.want)
+		}
+	}
+}
+
+// TestMutationsCheckAffectedRows runs the single-row mutations against a
+// database reporting the wrong number of affected rows.
+func TestMutationsCheckAffectedRows(t *testing.T) {
+	db, err := sql.Open("recorder", "")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	dal := newPollDAL(db, postgresDialect{}, "UTC", 1000, time.Second)
+	ctx := context.Background()
+	mutations := map[string]func() error{
+		"RenamePoll":   func() error { return dal.RenamePoll(ctx, 1, "Dinner?") },
+		"UpdateChoice": func() error { return dal.UpdateChoice(ctx, 2, "Sushi") },
+		"PausePoll":    func() error { return dal.PausePoll(ctx, 1) },
+		"DeletePoll":   func() error { return dal.DeletePoll(ctx, 1) },
+	}
+
+	defer recorder.setAffected(nil)
+	for _, tt := range []struct {
+		affected int64
+		want     error
+	}{{0, notFound}, {2, errUnexpectedRows}} {
+		n := tt.affected
+		recorder.setAffected(&n)
+		for name, mutate := range mutations {
+			if err := mutate(); err != tt.want {
+				t.Errorf("%s with %d rows affected = %v, want %v", name, tt.affected, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestResultsETag(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	pollID := strconv.FormatInt(p.ID, 10)
+
+	get := func(target, accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		a.Results(w, r)
+		return w
+	}
+
+	target := "/results?poll_id=" + pollID
+	w := get(target, "", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || w.Body.Len() == 0 {
+		t.Fatalf("status = %d with %d bytes, want 200 with a body", w.Code, w.Body.Len())
+	}
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("ETag = %q, want a weak ETag", etag)
+	}
+
+	w = get(target, "", etag)
+	if w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("revalidation status = %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+
+	// Other representations of the same results have their own tags.
+	for _, other := range []struct{ target, accept string }{
+		{target, "application/json"},
+		{"/results.csv?poll_id=" + pollID, ""},
+		{target + "&sort=order", ""},
+		{target + "&view=bars", ""},
+		{target + "&all=true", ""},
+	} {
+		if w := get(other.target, other.accept, etag); w.Code != 200 {
+			t.Errorf("%s (Accept %q) status = %d, want 200", other.target, other.accept, w.Code)
+		}
+	}
+
+	// So do the results once anything shown changes.
+	if err := dal.RenamePoll(context.Background(), p.ID, "Favourite colour?"); err != nil {
+		t.Fatalf("RenamePoll: %v", err)
+	}
+	if w := get(target, "", etag); w.Code != 200 {
+		t.Errorf("after rename status = %d, want 200", w.Code)
+	}
+	etag = get(target, "", "").Header().Get("ETag")
+
+	if err := dal.Answer(context.Background(), p.ID, []int64{cs[0].ID}, "c:one", ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+	if w := get(target, "", etag); w.Code != 200 {
+		t.Errorf("after vote status = %d, want 200", w.Code)
+	}
+}
+
+func TestTimelinesHonourHiddenResults(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, _ := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	dal.polls[p.ID].ResultsHidden = true
+	pollID := strconv.FormatInt(p.ID, 10)
+
+	handlers := map[string]http.HandlerFunc{
+		"Hourly":       a.Hourly,
+		"VoteTimeline": a.VoteTimeline,
+	}
+	for name, handler := range handlers {
+		r := httptest.NewRequest("GET", "/?poll_id="+pollID, nil)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != 403 {
+			t.Errorf("%s status = %d, want 403 while results are hidden", name, w.Code)
+		}
+
+		r = httptest.NewRequest("GET", "/?poll_id="+pollID, nil)
+		r.SetBasicAuth("admin", "secret")
+		w = httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != 200 {
+			t.Errorf("%s status = %d for an admin, want 200", name, w.Code)
+		}
+	}
+}
+
+// mapGeolocator resolves addresses from a fixed map.
+type mapGeolocator map[string]string
+
+func (g mapGeolocator) Region(ip string) string {
+	return g[ip]
+}
+
+func TestAnswerGeolocatesTrustedHop(t *testing.T) {
+	a, dal := newTestApp(t)
+	a.Geo = mapGeolocator{"198.51.100.1": "spoofed", "203.0.113.7": "CA"}
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	cookie, csrf := voterCookieFor(t)
+
+	form := url.Values{
+		"poll_id":   {strconv.FormatInt(p.ID, 10)},
+		"choice_id": {strconv.FormatInt(cs[0].ID, 10)},
+		csrfField:   {csrf},
+	}
+	r := httptest.NewRequest("POST", "/answer", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+	r.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	a.Answer(w, r)
+	if w.Code != 302 {
+		t.Fatalf("status = %d, want 302; body %q", w.Code, w.Body.String())
+	}
+
+	regions, err := dal.GetResultsByRegion(context.Background(), p.ID)
+	if err != nil {
+		t.Fatalf("GetResultsByRegion: %v", err)
+	}
+	if len(regions) != 1 || regions[0].Region != "CA" {
+		t.Errorf("regions = %+v, want the vote counted in CA", regions)
+	}
+}
+
+func TestResultsCountVotersByBallot(t *testing.T) {
+	a, dal := newTestApp(t)
+	ctx := context.Background()
+	p, err := dal.CreatePoll(ctx, "Toppings?", []string{"Cheese", "Ham", "Olives"}, 2, "admin")
+	if err != nil {
+		t.Fatalf("CreatePoll: %v", err)
+	}
+	cs, _, err := dal.GetChoices(ctx, p.ID)
+	if err != nil {
+		t.Fatalf("GetChoices: %v", err)
+	}
+
+	// Two anonymous ballots of two choices each, and one voter's of one.
+	for _, vote := range []struct {
+		voter   string
+		choices []int64
+	}{
+		{"", []int64{cs[0].ID, cs[1].ID}},
+		{"", []int64{cs[0].ID, cs[2].ID}},
+		{"c:one", []int64{cs[1].ID}},
+	} {
+		if err := dal.Answer(ctx, p.ID, vote.choices, vote.voter, ""); err != nil {
+			t.Fatalf("Answer(%q): %v", vote.voter, err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/results?poll_id="+strconv.FormatInt(p.ID, 10), nil)
+	r.Header.Set("Accept", "application/json")
+	a.Results(w, r)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+
+	var res struct {
+		Count      int64 `json:"count"`
+		VoterCount int64 `json:"voter_count"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if res.Count != 5 || res.VoterCount != 3 {
+		t.Errorf("count = %d, voter_count = %d; want 5 votes from 3 voters", res.Count, res.VoterCount)
+	}
+}
+
+func TestCreatePollWarnsOnDuplicateName(t *testing.T) {
+	a, dal := newTestApp(t)
+	createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+
+	for _, tt := range []struct {
+		name, warn string
+		warned     bool
+	}{
+		{"Lunch?", "true", true},
+		{"Dinner?", "true", false},
+		{"Lunch?", "", false},
+	} {
+		form := url.Values{"name": {tt.name}, "choice": {"Pizza", "Tacos"}, "warn_on_duplicate_name": {tt.warn}}
+		w := adminPost(a, a.CreatePoll, "/polls", form)
+		if w.Code != 302 {
+			t.Fatalf("%q: status = %d, want 302 whether or not it's a duplicate", tt.name, w.Code)
+		}
+		if warning := w.Header().Get("Warning"); (warning != "") != tt.warned {
+			t.Errorf("%q with warn_on_duplicate_name=%q: Warning = %q, want warned %v", tt.name, tt.warn, warning, tt.warned)
+		}
+	}
+
+	if polls, err := dal.ListPolls(context.Background(), 10, 0); err != nil || len(polls) != 4 {
+		t.Errorf("ListPolls = %d polls, %v; want all 4 created", len(polls), err)
+	}
+}
+
+func TestClosePollTwice(t *testing.T) {
+	_, dal := newTestApp(t)
+	p, _ := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	ctx := context.Background()
+
+	// Two admins closing the same poll both succeed, and it's closed once.
+	for i := 0; i < 2; i++ {
+		if err := dal.SetOpen(ctx, p.ID, false); err != nil {
+			t.Fatalf("close %d: %v", i+1, err)
+		}
+	}
+
+	events, err := dal.GetEvents(ctx, 100, 0)
+	if err != nil {
+		t.Fatalf("GetEvents: %v", err)
+	}
+	var closes int
+	for _, e := range events {
+		if e.Kind == "poll_closed" {
+			closes++
+		}
+	}
+	if closes != 1 {
+		t.Errorf("%d poll_closed events, want 1", closes)
+	}
+
+	if err := dal.SetOpen(ctx, p.ID+100, false); err != notFound {
+		t.Errorf("closing a missing poll err = %v, want notFound", err)
+	}
+}
+
+func TestClosedPollResultsComeFromSnapshot(t *testing.T) {
+	_, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	ctx := context.Background()
+
+	if err := dal.Answer(ctx, p.ID, []int64{cs[1].ID}, "c:one", ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+	if err := dal.SetOpen(ctx, p.ID, false); err != nil {
+		t.Fatalf("SetOpen: %v", err)
+	}
+	closed, err := dal.GetResults(ctx, p.ID, byVotes)
+	if err != nil {
+		t.Fatalf("GetResults: %v", err)
+	}
+
+	// Nothing that happens after closing changes the result.
+	if err := dal.Answer(ctx, p.ID, []int64{cs[0].ID}, "c:two", ""); err != errClosed {
+		t.Fatalf("vote on closed poll err = %v, want errClosed", err)
+	}
+	if err := dal.UpdateChoice(ctx, cs[1].ID, "Navy"); err != nil {
+		t.Fatalf("UpdateChoice: %v", err)
+	}
+	if _, err := dal.AddChoice(ctx, p.ID, "Green"); err != nil {
+		t.Fatalf("AddChoice: %v", err)
+	}
+
+	res, err := dal.GetResults(ctx, p.ID, byVotes)
+	if err != nil {
+		t.Fatalf("GetResults: %v", err)
+	}
+	got, _ := json.Marshal(res.Summaries)
+	want, _ := json.Marshal(closed.Summaries)
+	if string(got) != string(want) || res.Count != 1 || res.VoterCount != 1 {
+		t.Errorf("results after close = %s (%d votes, %d voters), want %s", got, res.Count, res.VoterCount, want)
+	}
+
+	// Reopening goes back to live results.
+	if err := dal.SetOpen(ctx, p.ID, true); err != nil {
+		t.Fatalf("SetOpen: %v", err)
+	}
+	res, err = dal.GetResults(ctx, p.ID, byVotes)
+	if err != nil {
+		t.Fatalf("GetResults: %v", err)
+	}
+	if len(res.Summaries) != 3 || res.Summaries[0].Answer != "Navy" {
+		t.Errorf("reopened results = %+v, want the live choices", res.Summaries)
+	}
+}
+
+func TestResultsVisibility(t *testing.T) {
+	a, dal := newTestApp(t)
+
+	get := func(pollID int64, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/results?poll_id="+strconv.FormatInt(pollID, 10), nil)
+		if auth != "" {
+			r.SetBasicAuth(auth, "secret")
+		}
+		w := httptest.NewRecorder()
+		a.Results(w, r)
+		return w
+	}
+
+	for _, tt := range []struct {
+		visibility, owner string
+		open              bool
+		auth              string
+		want              int
+		hidden            bool
+	}{
+		{visibilityPublic, "admin", true, "", 200, false},
+		{visibilityOwner, "admin", true, "", 403, false},
+		{visibilityOwner, "admin", false, "", 403, false},
+		{visibilityOwner, "admin", true, "admin", 200, false},
+		{visibilityOwner, "someone", true, "admin", 403, false},
+		{visibilityOwner, "", true, "admin", 200, false},
+		{visibilityAfterClose, "admin", true, "", 200, true},
+		{visibilityAfterClose, "admin", false, "", 200, false},
+	} {
+		p, _ := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+		dal.polls[p.ID].ResultsVisibility = tt.visibility
+		dal.polls[p.ID].Owner = tt.owner
+		if !tt.open {
+			if err := dal.SetOpen(context.Background(), p.ID, false); err != nil {
+				t.Fatalf("SetOpen: %v", err)
+			}
+		}
+
+		w := get(p.ID, tt.auth)
+		hidden := strings.Contains(w.Body.String(), "hidden until this poll closes")
+		if w.Code != tt.want || hidden != tt.hidden {
+			t.Errorf("%s poll by %q (open %v) as %q: status = %d, hidden %v; want %d, hidden %v",
+				tt.visibility, tt.owner, tt.open, tt.auth, w.Code, hidden, tt.want, tt.hidden)
+		}
+	}
+}
+
+func TestBallotsExport(t *testing.T) {
+	a, dal := newTestApp(t)
+	ctx := context.Background()
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	other, otherCs := createTestPoll(t, dal, "Best shape?", "Circle", "Square")
+
+	voterA := "c:0123456789abcdef0123456789abcdef"
+	voterB := "ip:" + voters.mac("ip:203.0.113.7")[:32]
+	for _, vote := range []struct {
+		pollID, choiceID int64
+		voter            string
+	}{
+		{p.ID, cs[0].ID, voterA},
+		{p.ID, cs[1].ID, voterB},
+		{other.ID, otherCs[0].ID, voterA},
+	} {
+		if err := dal.Answer(ctx, vote.pollID, []int64{vote.choiceID}, vote.voter, ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	export := func(pollID int64) [][]string {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/admin/ballots?poll_id="+strconv.FormatInt(pollID, 10), nil)
+		r.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		a.requireAdmin(a.Ballots)(w, r)
+		if w.Code != 200 {
+			t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+		}
+		for _, raw := range []string{voterA, voterB, "0123456789abcdef", "203.0.113.7"} {
+			if strings.Contains(w.Body.String(), raw) {
+				t.Errorf("export contains %q:\n%s", raw, w.Body.String())
+			}
+		}
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("parsing CSV: %v", err)
+		}
+		return rows[1:]
+	}
+
+	rows := export(p.ID)
+	if len(rows) != 2 || rows[0][0] == rows[1][0] || rows[0][0] == "" {
+		t.Fatalf("rows = %q, want one per voter with distinct tokens", rows)
+	}
+	if rows[0][1] != strconv.FormatInt(cs[0].ID, 10) {
+		t.Errorf("first ballot choices = %q, want %d", rows[0][1], cs[0].ID)
+	}
+	if again := export(p.ID); again[0][0] != rows[0][0] {
+		t.Errorf("token changed between exports: %q then %q", rows[0][0], again[0][0])
+	}
+	if otherRows := export(other.ID); otherRows[0][0] == rows[0][0] {
+		t.Errorf("voter has the same token %q in two polls", rows[0][0])
+	}
+}
+
+func TestVoteChangeWindow(t *testing.T) {
+	_, dal := newTestApp(t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	dal.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	dal.polls[p.ID].VoteChangeWindow = 600
+
+	counts := func() (int64, int64) {
+		t.Helper()
+		res, err := dal.GetResults(ctx, p.ID, byChoiceOrder)
+		if err != nil {
+			t.Fatalf("GetResults: %v", err)
+		}
+		return res.Summaries[0].Count, res.Summaries[1].Count
+	}
+
+	if err := dal.Answer(ctx, p.ID, []int64{cs[0].ID}, "c:one", ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+
+	// Within the window, voting again moves the vote.
+	now = now.Add(5 * time.Minute)
+	if err := dal.Answer(ctx, p.ID, []int64{cs[1].ID}, "c:one", ""); err != nil {
+		t.Fatalf("changing vote: %v", err)
+	}
+	if red, blue := counts(); red != 0 || blue != 1 {
+		t.Errorf("after change red = %d, blue = %d; want 0 and 1", red, blue)
+	}
+	if p, _ := dal.GetByID(ctx, p.ID); p.VoteCount != 1 {
+		t.Errorf("vote_count = %d, want 1", p.VoteCount)
+	}
+
+	// The window runs from the first vote, not the change.
+	now = now.Add(5 * time.Minute)
+	if err := dal.Answer(ctx, p.ID, []int64{cs[0].ID}, "c:one", ""); err != errAlreadyVoted {
+		t.Errorf("after window err = %v, want errAlreadyVoted", err)
+	}
+	if red, blue := counts(); red != 0 || blue != 1 {
+		t.Errorf("after rejected change red = %d, blue = %d; want 0 and 1", red, blue)
+	}
+}
+
+func TestIndexPreselectsPriorChoice(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	dal.polls[p.ID].VoteChangeWindow = 600
+	cookie, _ := voterCookieFor(t)
+	token, _ := voters.Verify(cookie.Value)
+
+	index := func() string {
+		r := httptest.NewRequest("GET", "/?poll_id="+strconv.FormatInt(p.ID, 10), nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		a.Index(w, r)
+		if w.Code != 200 {
+			t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	if body := index(); strings.Contains(body, "checked") {
+		t.Errorf("choice pre-selected before voting:\n%s", body)
+	}
+
+	if err := dal.Answer(context.Background(), p.ID, []int64{cs[1].ID}, "c:"+token, ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+	body := index()
+	want := `value="` + strconv.FormatInt(cs[1].ID, 10) + `" checked`
+	if !strings.Contains(body, want) || strings.Count(body, "checked") != 1 {
+		t.Errorf("body doesn't check only the prior choice with %s:\n%s", want, body)
+	}
+}
+
+func TestAllowHeader(t *testing.T) {
+	a, _ := newTestApp(t)
+
+	for _, tt := range []struct {
+		name    string
+		handler http.HandlerFunc
+		wrong   string
+		allow   string
+	}{
+		{"Results", a.Results, "POST", "GET"},
+		{"Answer", a.Answer, "GET", "POST"},
+		{"Index", a.Index, "DELETE", "GET"},
+	} {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest(tt.wrong, "/", nil))
+		if w.Code != 405 || w.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s %s: status = %d, Allow = %q; want 405 and %q", tt.wrong, tt.name, w.Code, w.Header().Get("Allow"), tt.allow)
+		}
+
+		w = httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest("OPTIONS", "/", nil))
+		if w.Code != 204 || w.Header().Get("Allow") != tt.allow || w.Body.Len() != 0 {
+			t.Errorf("OPTIONS %s: status = %d, Allow = %q, %d bytes; want an empty 204 with Allow %q", tt.name, w.Code, w.Header().Get("Allow"), w.Body.Len(), tt.allow)
+		}
+	}
+}
+
+func TestSecondVoteRejected(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	first, firstCSRF := voterCookieFor(t)
+	second, secondCSRF := voterCookieFor(t)
+
+	vote := func(cookie *http.Cookie, csrf string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"poll_id":   {strconv.FormatInt(p.ID, 10)},
+			"choice_id": {strconv.FormatInt(cs[0].ID, 10)},
+			csrfField:   {csrf},
+		}
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		a.Answer(w, r)
+		return w
+	}
+
+	if w := vote(first, firstCSRF); w.Code != 302 {
+		t.Fatalf("first vote status = %d, want 302; body %q", w.Code, w.Body.String())
+	}
+	w := vote(first, firstCSRF)
+	if w.Code != 409 || !strings.Contains(w.Body.String(), "already voted") {
+		t.Errorf("second vote status = %d, body %q; want 409 saying they already voted", w.Code, w.Body.String())
+	}
+	if w := vote(second, secondCSRF); w.Code != 302 {
+		t.Errorf("another voter's vote status = %d, want 302", w.Code)
+	}
+	if w := vote(nil, firstCSRF); w.Code != 403 {
+		t.Errorf("vote without a voter cookie status = %d, want 403", w.Code)
+	}
+
+	if p, _ := dal.GetByID(context.Background(), p.ID); p.VoteCount != 2 {
+		t.Errorf("vote_count = %d, want 2", p.VoteCount)
+	}
+}
+
+func TestListPollsByOwner(t *testing.T) {
+	a, dal := newTestApp(t)
+	for _, p := range []struct{ name, owner string }{
+		{"Alice's lunch", "alice"},
+		{"Bob's lunch", "bob"},
+		{"Alice's dinner", "alice"},
+	} {
+		if _, err := dal.CreatePoll(context.Background(), p.name, []string{"Yes", "No"}, 1, p.owner); err != nil {
+			t.Fatalf("CreatePoll: %v", err)
+		}
+	}
+
+	list := func(target string) string {
+		w := httptest.NewRecorder()
+		a.ListPolls(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s status = %d, want 200", target, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	body := list("/polls?owner=alice")
+	for _, name := range []string{"Alice&#39;s lunch", "Alice&#39;s dinner"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("alice's polls lack %q", name)
+		}
+	}
+	if strings.Contains(body, "Bob") {
+		t.Errorf("alice's polls include bob's: %q", body)
+	}
+
+	if body := list("/polls?owner=carol"); !strings.Contains(body, "No polls here.") || strings.Contains(body, "lunch") {
+		t.Errorf("carol's polls = %q, want none", body)
+	}
+	if body := list("/polls"); !strings.Contains(body, "Alice&#39;s lunch") || !strings.Contains(body, "Bob&#39;s lunch") {
+		t.Errorf("unfiltered polls lack someone's: %q", body)
+	}
+}
+
+// TestCloseAtBoundary checks that a poll stops taking votes, and is closed
+// as expired, from the instant of its close_at on.
+func TestCloseAtBoundary(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		offset time.Duration
+		closed bool
+	}{
+		{"past", -time.Second, true},
+		{"now", 0, true},
+		{"future", time.Second, false},
+	}
+
+	for _, c := range cases {
+		_, dal := newTestApp(t)
+		dal.now = func() time.Time { return now }
+		p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+		closeAt := now.Add(c.offset)
+		dal.polls[p.ID].CloseAt = &closeAt
+
+		err := dal.Answer(context.Background(), p.ID, []int64{cs[0].ID}, "c:voter", "")
+		if c.closed && err != errClosed {
+			t.Errorf("%s: Answer err = %v, want errClosed", c.name, err)
+		} else if !c.closed && err != nil {
+			t.Errorf("%s: Answer err = %v, want nil", c.name, err)
+		}
+
+		n, err := dal.CloseExpiredPolls(context.Background())
+		if err != nil {
+			t.Fatalf("%s: CloseExpiredPolls: %v", c.name, err)
+		}
+		want := int64(0)
+		if c.closed {
+			want = 1
+		}
+		if n != want {
+			t.Errorf("%s: CloseExpiredPolls closed %d, want %d", c.name, n, want)
+		}
+		if dal.polls[p.ID].IsOpen == c.closed {
+			t.Errorf("%s: is_open = %t, want %t", c.name, dal.polls[p.ID].IsOpen, !c.closed)
+		}
+	}
+}
+
+// TestBadRequestMessages checks that every 400 says what was wrong, as
+// text or, for JSON clients, as {"error": ...}.
+func TestBadRequestMessages(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, _ := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	pollID := strconv.FormatInt(p.ID, 10)
+	cookie, csrf := voterCookieFor(t)
+
+	cases := []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+		form    url.Values
+		want    string
+	}{
+		{a.Index, "GET", "/?poll_id=x", nil, "invalid poll_id"},
+		{a.Results, "GET", "/results", nil, "missing or invalid poll_id"},
+		{a.Results, "GET", "/results?poll_id=" + pollID + "&sort=x", nil, "sort must be votes or order"},
+		{a.ResultsPNG, "GET", "/results.png", nil, "missing or invalid poll_id"},
+		{a.ResultsPNG, "GET", "/results.png?poll_id=" + pollID + "&sort=x", nil, "sort must be votes or order"},
+		{a.Answer, "POST", "/answer", url.Values{"poll_id": {pollID}, csrfField: {csrf}}, "choice_id required"},
+		{a.Hourly, "GET", "/results/hourly", nil, "missing or invalid poll_id"},
+		{a.ResultsDelta, "GET", "/results/delta", nil, "missing or invalid poll_id"},
+		{a.ResultsDelta, "GET", "/results/delta?poll_id=" + pollID + "&since=x", nil, "since must be an RFC 3339 time"},
+		{a.CTR, "GET", "/results/ctr", nil, "missing or invalid poll_id"},
+		{a.ResultsByRegion, "GET", "/results/regions", nil, "missing or invalid poll_id"},
+		{a.MarginTimeline, "GET", "/results/margin", nil, "missing or invalid poll_id"},
+		{a.MarginTimeline, "GET", "/results/margin?poll_id=" + pollID + "&bucket=1ms", nil, "bucket must be a duration of at least 1s"},
+		{a.VoteTimeline, "GET", "/results/timeline", nil, "missing or invalid poll_id"},
+		{a.VoteTimeline, "GET", "/results/timeline?poll_id=" + pollID + "&bucket=week", nil, "bucket must be minute, hour or day"},
+		{a.AnswerTimestamps, "GET", "/results/timestamps", nil, "missing or invalid poll_id"},
+		{a.ListPolls, "GET", "/polls?limit=x", nil, "limit must be a number"},
+		{a.ListPolls, "GET", "/polls?offset=-1", nil, "offset must be a non-negative number"},
+		{a.Events, "GET", "/admin/events?limit=0", nil, "limit must be a positive number"},
+		{a.Events, "GET", "/admin/events?offset=-1", nil, "offset must be a non-negative number"},
+		{a.EmptyPolls, "GET", "/admin/empty?older_than=x", nil, "older_than must be a non-negative duration"},
+		{a.Ballots, "GET", "/admin/ballots", nil, "missing or invalid poll_id"},
+		{a.CreatePoll, "POST", "/admin/create", url.Values{"name": {"Dinner?"}, "choice": {"Soup", "Salad"}, "max_selections": {"x"}}, "max_selections must be a number"},
+		{a.Close, "POST", "/admin/close", nil, "missing or invalid poll_id"},
+		{a.Pause, "POST", "/admin/pause", nil, "missing or invalid poll_id"},
+		{a.Rename, "POST", "/admin/rename?name=Dinner", nil, "missing or invalid poll_id"},
+		{a.UpdateChoice, "POST", "/admin/update_choice?answer=Sushi", nil, "missing or invalid choice_id"},
+		{a.AddChoice, "POST", "/admin/add_choice?answer=Sushi", nil, "missing or invalid poll_id"},
+		{a.Delete, "POST", "/admin/delete", nil, "missing or invalid poll_id"},
+	}
+
+	for _, c := range cases {
+		for _, accept := range []string{"text/plain", "application/json"} {
+			r := httptest.NewRequest(c.method, c.target, strings.NewReader(c.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", accept)
+			r.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			c.handler(w, r)
+
+			if w.Code != 400 {
+				t.Errorf("%s %s (%s): status = %d, want 400; body %q", c.method, c.target, accept, w.Code, w.Body.String())
+				continue
+			}
+
+			body := w.Body.String()
+			if accept == "application/json" {
+				var e struct {
+					Error string `json:"error"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+					t.Errorf("%s %s: Unmarshal(%q): %v", c.method, c.target, body, err)
+				}
+				body = e.Error
+			}
+			if body != c.want {
+				t.Errorf("%s %s (%s): message = %q, want %q", c.method, c.target, accept, body, c.want)
+			}
+		}
+	}
+}
+
+func TestHourly(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i, at := range []time.Duration{
+		9*time.Hour + 15*time.Minute,
+		9*time.Hour + 45*time.Minute,
+		23 * time.Hour,
+	} {
+		now := day.Add(at)
+		dal.now = func() time.Time { return now }
+		if err := dal.Answer(context.Background(), p.ID, []int64{cs[0].ID}, "c:voter"+strconv.Itoa(i), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	hourly := func() [24]int64 {
+		w := httptest.NewRecorder()
+		a.Hourly(w, httptest.NewRequest("GET", "/api/hourly?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+		if w.Code != 200 {
+			t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+		}
+		var res struct {
+			Hours [24]int64 `json:"hours"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		return res.Hours
+	}
+
+	var want [24]int64
+	want[9], want[23] = 2, 1
+	if got := hourly(); got != want {
+		t.Errorf("hours in UTC = %v, want %v", got, want)
+	}
+
+	// In a zone two hours ahead, 23:00 UTC falls into the next day's 1am.
+	dal.timezone = time.FixedZone("UTC+2", 2*60*60)
+	want = [24]int64{}
+	want[11], want[1] = 2, 1
+	if got := hourly(); got != want {
+		t.Errorf("hours in UTC+2 = %v, want %v", got, want)
+	}
+}
+
+func TestResultsDelta(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	votes := []struct {
+		at     time.Duration
+		choice int
+	}{
+		{0, 0}, {0, 0}, {0, 1},
+		{30 * time.Minute, 0}, {30 * time.Minute, 1}, {30 * time.Minute, 1},
+	}
+	for i, v := range votes {
+		now := start.Add(v.at)
+		dal.now = func() time.Time { return now }
+		if err := dal.Answer(context.Background(), p.ID, []int64{cs[v.choice].ID}, "c:voter"+strconv.Itoa(i), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	type change struct {
+		Answer         string  `json:"answer"`
+		Count          int64   `json:"count"`
+		Change         int64   `json:"change"`
+		RelativeChange float64 `json:"relative_change"`
+	}
+	deltas := func(since time.Time) []change {
+		w := httptest.NewRecorder()
+		a.ResultsDelta(w, httptest.NewRequest("GET", "/api/results/delta?poll_id="+strconv.FormatInt(p.ID, 10)+"&since="+since.Format(time.RFC3339), nil))
+		if w.Code != 200 {
+			t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+		}
+		var res struct {
+			Choices []change `json:"choices"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		return res.Choices
+	}
+
+	got := deltas(start.Add(15 * time.Minute))
+	want := []change{{"Pizza", 3, 1, 0.5}, {"Tacos", 3, 2, 2}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("deltas since 10:15 = %+v, want %+v", got, want)
+	}
+
+	got = deltas(start.Add(time.Hour))
+	want = []change{{"Pizza", 3, 0, 0}, {"Tacos", 3, 0, 0}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("deltas since the future = %+v, want %+v", got, want)
+	}
+}
+
+func TestDrainingRefusesVotes(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	cookie, csrf := voterCookieFor(t)
+
+	vote := func() *httptest.ResponseRecorder {
+		form := url.Values{
+			"poll_id":   {strconv.FormatInt(p.ID, 10)},
+			"choice_id": {strconv.FormatInt(cs[0].ID, 10)},
+			csrfField:   {csrf},
+		}
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		a.Answer(w, r)
+		return w
+	}
+	results := func() int {
+		w := httptest.NewRecorder()
+		a.Results(w, httptest.NewRequest("GET", "/api/results?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+		return w.Code
+	}
+
+	a.SetDraining(true)
+	if w := vote(); w.Code != 503 || w.Body.String() != "Service Draining" {
+		t.Errorf("vote while draining: status = %d, body %q; want 503 Service Draining", w.Code, w.Body.String())
+	}
+	if code := results(); code != 200 {
+		t.Errorf("results while draining status = %d, want 200", code)
+	}
+	if p, _ := dal.GetByID(context.Background(), p.ID); p.VoteCount != 0 {
+		t.Errorf("vote_count = %d, want 0", p.VoteCount)
+	}
+
+	a.SetDraining(false)
+	if w := vote(); w.Code != 302 {
+		t.Errorf("vote after draining status = %d, want 302", w.Code)
+	}
+}
+
+func TestResultsTieOrder(t *testing.T) {
+	_, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos", "Sushi")
+
+	// Tacos gets its vote first, but Pizza was added first.
+	for i, c := range []int{1, 0, 2, 2} {
+		if err := dal.Answer(context.Background(), p.ID, []int64{cs[c].ID}, "c:voter"+strconv.Itoa(i), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		res, err := dal.GetResults(context.Background(), p.ID, byVotes)
+		if err != nil {
+			t.Fatalf("GetResults: %v", err)
+		}
+		var got []string
+		for _, s := range res.Summaries {
+			got = append(got, s.Answer)
+		}
+		if strings.Join(got, ",") != "Sushi,Pizza,Tacos" {
+			t.Fatalf("call %d: order = %v, want Sushi, then Pizza and Tacos tied in the order added", i, got)
+		}
+	}
+}
+
+func TestResultsCategorySubtotals(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Salad", "Soup", "Tea")
+	for i, category := range []string{"Hot", "Cold", "Hot", ""} {
+		dal.choices[cs[i].ID].Category = category
+	}
+	for i, c := range []int{0, 0, 1, 2, 3, 3, 3} {
+		if err := dal.Answer(context.Background(), p.ID, []int64{cs[c].ID}, "c:voter"+strconv.Itoa(i), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/api/results?poll_id="+strconv.FormatInt(p.ID, 10)+"&sort=order", nil))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+	var res struct {
+		Count      int64 `json:"count"`
+		Categories []struct {
+			Name  string `json:"name"`
+			Count int64  `json:"count"`
+		} `json:"categories"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	want := map[string]int64{"Hot": 3, "Cold": 1, "": 3}
+	var total int64
+	for _, c := range res.Categories {
+		if c.Count != want[c.Name] {
+			t.Errorf("category %q subtotal = %d, want %d", c.Name, c.Count, want[c.Name])
+		}
+		delete(want, c.Name)
+		total += c.Count
+	}
+	if len(want) != 0 {
+		t.Errorf("categories missing: %v", want)
+	}
+	if total != res.Count || res.Count != 7 {
+		t.Errorf("subtotals sum to %d, count = %d; want both 7", total, res.Count)
+	}
+}
+
+func TestCTR(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos", "Sushi")
+
+	if err := dal.RecordImpressions(context.Background(), map[int64]int64{cs[0].ID: 3, cs[2].ID: 10}); err != nil {
+		t.Fatalf("RecordImpressions: %v", err)
+	}
+	if err := dal.RecordImpressions(context.Background(), map[int64]int64{cs[0].ID: 1}); err != nil {
+		t.Fatalf("RecordImpressions: %v", err)
+	}
+	for i, c := range []int{0, 0, 1} {
+		if err := dal.Answer(context.Background(), p.ID, []int64{cs[c].ID}, "c:voter"+strconv.Itoa(i), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.CTR(w, httptest.NewRequest("GET", "/api/ctr?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+
+	type rate struct {
+		Answer      string  `json:"answer"`
+		Impressions int64   `json:"impressions"`
+		Votes       int64   `json:"votes"`
+		Rate        float64 `json:"rate"`
+	}
+	var res struct {
+		Choices []rate `json:"choices"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	// Tacos was voted for without being shown, so has no rate.
+	want := []rate{{"Pizza", 4, 2, 0.5}, {"Tacos", 0, 1, 0}, {"Sushi", 10, 0, 0}}
+	if len(res.Choices) != len(want) {
+		t.Fatalf("choices = %+v, want %+v", res.Choices, want)
+	}
+	for i := range want {
+		if res.Choices[i] != want[i] {
+			t.Errorf("choice %d = %+v, want %+v", i, res.Choices[i], want[i])
+		}
+	}
+}
+
+func TestImpressionLoggerDropsWhenFull(t *testing.T) {
+	_, dal := newTestApp(t)
+	_, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos", "Sushi")
+
+	l := newImpressionLogger(dal, 2, time.Hour)
+	l.Record(cs)
+	if n := len(l.queue); n != 2 {
+		t.Errorf("queued %d impressions, want 2 with the rest dropped", n)
+	}
+}
+
+func TestVoteCountReconciles(t *testing.T) {
+	_, dal := newTestApp(t)
+	ctx := context.Background()
+	lunch, lunchChoices := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	dinner, dinnerChoices := createTestPoll(t, dal, "Dinner?", "Soup", "Stew")
+
+	for i := 0; i < 5; i++ {
+		if err := dal.Answer(ctx, lunch.ID, []int64{lunchChoices[i%2].ID}, "c:voter"+strconv.Itoa(i), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+	if err := dal.Answer(ctx, dinner.ID, []int64{dinnerChoices[0].ID}, "c:voter", ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+
+	counts := func() (int64, int64) {
+		l, _ := dal.GetByID(ctx, lunch.ID)
+		d, _ := dal.GetByID(ctx, dinner.ID)
+		return l.VoteCount, d.VoteCount
+	}
+	if l, d := counts(); l != 5 || d != 1 {
+		t.Fatalf("vote_counts = %d, %d; want 5, 1", l, d)
+	}
+
+	// Drift one poll's count away from its answers.
+	dal.polls[lunch.ID].VoteCount = 42
+	fixed, err := dal.ReconcileVoteCounts(ctx)
+	if err != nil {
+		t.Fatalf("ReconcileVoteCounts: %v", err)
+	}
+	if fixed != 1 {
+		t.Errorf("fixed %d polls, want 1", fixed)
+	}
+	if l, d := counts(); l != 5 || d != 1 {
+		t.Errorf("vote_counts after reconciling = %d, %d; want 5, 1", l, d)
+	}
+
+	if fixed, _ := dal.ReconcileVoteCounts(ctx); fixed != 0 {
+		t.Errorf("reconciling again fixed %d polls, want 0", fixed)
+	}
+}
+
+func TestResultsNegotiation(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+	if err := dal.Answer(context.Background(), p.ID, []int64{cs[1].ID}, "c:one", ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+
+	target := "/results?poll_id=" + strconv.FormatInt(p.ID, 10)
+	for _, tt := range []struct {
+		accept      string
+		contentType string
+		check       func(body []byte) error
+	}{
+		{"", "text/html", nil},
+		{"text/html", "text/html", nil},
+		{"application/json", "application/json", func(body []byte) error {
+			var res struct {
+				Count int64 `json:"count"`
+			}
+			return json.Unmarshal(body, &res)
+		}},
+		{"text/csv", "text/csv", func(body []byte) error {
+			_, err := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+			return err
+		}},
+		{"text/html;q=0.5, application/json", "application/json", nil},
+		{"image/png", "text/html", nil},
+	} {
+		r := httptest.NewRequest("GET", target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		a.Results(w, r)
+
+		if w.Code != 200 {
+			t.Errorf("Accept %q: status = %d, want 200", tt.accept, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+			t.Errorf("Accept %q: Content-Type = %q, want %s", tt.accept, ct, tt.contentType)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Accept" {
+			t.Errorf("Accept %q: Vary = %q, want Accept", tt.accept, vary)
+		}
+		if !strings.Contains(w.Body.String(), "Blue") {
+			t.Errorf("Accept %q: body lacks the results: %q", tt.accept, w.Body.String())
+		}
+		if tt.check != nil {
+			if err := tt.check(w.Body.Bytes()); err != nil {
+				t.Errorf("Accept %q: body doesn't parse as %s: %v", tt.accept, tt.contentType, err)
+			}
+		}
+	}
+}
+
+func TestCloseAll(t *testing.T) {
+	a, dal := newTestApp(t)
+	ctx := context.Background()
+
+	var polls []*poll
+	for _, name := range []string{"Lunch?", "Dinner?", "Breakfast?", "Brunch?", "Supper?"} {
+		p, _ := createTestPoll(t, dal, name, "Yes", "No")
+		polls = append(polls, p)
+	}
+	for _, p := range polls[3:] {
+		if err := dal.SetOpen(ctx, p.ID, false); err != nil {
+			t.Fatalf("SetOpen: %v", err)
+		}
+	}
+
+	w := adminPost(a, a.CloseAll, "/admin/close-all", nil)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+	var res struct {
+		Closed int64 `json:"closed"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if res.Closed != 3 {
+		t.Errorf("closed = %d, want the 3 that were open", res.Closed)
+	}
+	for _, p := range polls {
+		if p, _ := dal.GetByID(ctx, p.ID); p.IsOpen {
+			t.Errorf("poll %q still open", p.Name)
+		}
+	}
+
+	if w := adminPost(a, a.CloseAll, "/admin/close-all", nil); !strings.Contains(w.Body.String(), `"closed":0`) {
+		t.Errorf("closing all again = %q, want none closed", w.Body.String())
+	}
+}
+
+func TestResultsTopN(t *testing.T) {
+	a, dal := newTestApp(t)
+	a.MaxRenderedResults = 2
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos", "Sushi", "Soup", "Salad")
+	var voter int
+	for i, n := range []int{4, 3, 2, 1, 0} {
+		for j := 0; j < n; j++ {
+			voter++
+			if err := dal.Answer(context.Background(), p.ID, []int64{cs[i].ID}, "c:voter"+strconv.Itoa(voter), ""); err != nil {
+				t.Fatalf("Answer: %v", err)
+			}
+		}
+	}
+
+	get := func(path, query string) string {
+		target := path + "?poll_id=" + strconv.FormatInt(p.ID, 10) + query
+		w := httptest.NewRecorder()
+		a.Results(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s status = %d, want 200", target, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	body := get("/results", "")
+	for _, want := range []string{"Pizza: 4 votes", "Tacos: 3 votes", "Other (3 choices): 3 votes", "all=true\">Show all"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("top 2 lacks %q: %q", want, body)
+		}
+	}
+	for _, hidden := range []string{"Sushi", "Soup", "Salad"} {
+		if strings.Contains(body, hidden) {
+			t.Errorf("top 2 shows %q", hidden)
+		}
+	}
+
+	body = get("/results", "&all=true")
+	if !strings.Contains(body, "Salad: 0 votes") || strings.Contains(body, "Other (") {
+		t.Errorf("all=true = %q, want every choice and no others row", body)
+	}
+
+	// Exports aren't capped.
+	var res struct {
+		Summaries []json.RawMessage `json:"summaries"`
+	}
+	if err := json.Unmarshal([]byte(get("/api/results", "")), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(res.Summaries) != 5 {
+		t.Errorf("JSON has %d summaries, want all 5", len(res.Summaries))
+	}
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	a, dal := newTestApp(t)
+	a.ReadOnly = true
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	cookie, csrf := voterCookieFor(t)
+
+	form := url.Values{
+		"poll_id":   {strconv.FormatInt(p.ID, 10)},
+		"choice_id": {strconv.FormatInt(cs[0].ID, 10)},
+		csrfField:   {csrf},
+	}
+	r := httptest.NewRequest("POST", "/answer", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	a.Answer(w, r)
+	if w.Code != 503 || w.Body.String() != "Read-Only Mode" {
+		t.Errorf("vote: status = %d, body %q; want 503 Read-Only Mode", w.Code, w.Body.String())
+	}
+
+	w = adminPost(a, a.CreatePoll, "/admin/create", url.Values{"name": {"Dinner?"}, "choice": {"Soup", "Stew"}})
+	if w.Code != 503 {
+		t.Errorf("create poll status = %d, want 503", w.Code)
+	}
+	w = adminPost(a, a.Close, "/admin/close", url.Values{"poll_id": {strconv.FormatInt(p.ID, 10)}})
+	if w.Code != 503 {
+		t.Errorf("close poll status = %d, want 503", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/api/results?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+	if w.Code != 200 {
+		t.Errorf("results status = %d, want 200", w.Code)
+	}
+
+	if p, _ := dal.GetByID(context.Background(), p.ID); p.VoteCount != 0 || !p.IsOpen {
+		t.Errorf("poll = %d votes, open %t; want it untouched", p.VoteCount, p.IsOpen)
+	}
+}
+
+func TestAnswerByText(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Coffee?", "Yes", "Yep", "No")
+	dal.AddSynonym("yep", "yes")
+
+	vote := func(answer string) *httptest.ResponseRecorder {
+		cookie, _ := voterCookieFor(t)
+		body := `{"poll_id": "` + strconv.FormatInt(p.ID, 10) + `", "answer": "` + answer + `"}`
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		a.Answer(w, r)
+		return w
+	}
+
+	// Matching ignores case and runs of whitespace.
+	if w := vote("  NO "); w.Code != 201 {
+		t.Errorf("unique match status = %d, want 201; body %q", w.Code, w.Body.String())
+	}
+	if w := vote("Maybe"); w.Code != 422 || !strings.Contains(w.Body.String(), errNoMatchingChoice.Error()) {
+		t.Errorf("no match: status = %d, body %q; want 422 saying nothing matched", w.Code, w.Body.String())
+	}
+	// "Yes" and "Yep" are both yes once synonyms apply.
+	if w := vote("yes"); w.Code != 422 || !strings.Contains(w.Body.String(), errAmbiguousChoice.Error()) {
+		t.Errorf("ambiguous match: status = %d, body %q; want 422 saying several matched", w.Code, w.Body.String())
+	}
+
+	res, err := dal.GetResults(context.Background(), p.ID, byChoiceOrder)
+	if err != nil {
+		t.Fatalf("GetResults: %v", err)
+	}
+	if res.Count != 1 || res.Summaries[2].ID != cs[2].ID || res.Summaries[2].Count != 1 {
+		t.Errorf("results = %d votes, want the 1 for No", res.Count)
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	for _, tt := range []struct {
+		counts []int64
+		want   float64
+	}{
+		{nil, 0},
+		{[]int64{5}, 0},
+		{[]int64{5, 0, 0}, 0},
+		{[]int64{3, 3}, 1},
+		{[]int64{2, 2, 2, 2}, 2},
+		{[]int64{1, 3}, 0.8112781244591328},
+	} {
+		if got := entropy(tt.counts); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("entropy(%v) = %v, want %v", tt.counts, got, tt.want)
+		}
+	}
+}
+
+func TestResultsEntropy(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	for i, c := range []int{0, 1} {
+		if err := dal.Answer(context.Background(), p.ID, []int64{cs[c].ID}, "c:voter"+strconv.Itoa(i), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/api/results?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+	var res struct {
+		Entropy float64 `json:"entropy"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if res.Entropy != 1 {
+		t.Errorf("entropy of an even two-way split = %v, want 1", res.Entropy)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	pollID := url.Values{"poll_id": {strconv.FormatInt(p.ID, 10)}}
+
+	vote := func() *httptest.ResponseRecorder {
+		cookie, csrf := voterCookieFor(t)
+		form := url.Values{
+			"poll_id":   {strconv.FormatInt(p.ID, 10)},
+			"choice_id": {strconv.FormatInt(cs[0].ID, 10)},
+			csrfField:   {csrf},
+		}
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		a.Answer(w, r)
+		return w
+	}
+
+	if w := adminPost(a, a.Pause, "/admin/pause", pollID); w.Code != 200 || !strings.Contains(w.Body.String(), `"paused":true`) {
+		t.Fatalf("pause: status = %d, body %q", w.Code, w.Body.String())
+	}
+	if w := vote(); w.Code != 423 || w.Body.String() != "Voting Paused" {
+		t.Errorf("vote while paused: status = %d, body %q; want 423 Voting Paused", w.Code, w.Body.String())
+	}
+	if p, _ := dal.GetByID(context.Background(), p.ID); !p.IsOpen || !p.Paused {
+		t.Errorf("paused poll: open %t, paused %t; want open and paused", p.IsOpen, p.Paused)
+	}
+
+	w := httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/api/results?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+	if w.Code != 200 {
+		t.Errorf("results while paused status = %d, want 200", w.Code)
+	}
+
+	if w := adminPost(a, a.Resume, "/admin/resume", pollID); w.Code != 200 || !strings.Contains(w.Body.String(), `"paused":false`) {
+		t.Fatalf("resume: status = %d, body %q", w.Code, w.Body.String())
+	}
+	if w := vote(); w.Code != 302 {
+		t.Errorf("vote after resuming status = %d, want 302", w.Code)
+	}
+}
+
+func TestMarginTimelineLeadChange(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	votes := []struct {
+		at     time.Duration
+		choice int
+	}{
+		// Pizza leads by 2 in the first hour, Tacos overtakes it in the
+		// second and it's level in the third.
+		{5 * time.Minute, 0}, {10 * time.Minute, 0}, {15 * time.Minute, 1}, {20 * time.Minute, 0},
+		{65 * time.Minute, 1}, {70 * time.Minute, 1}, {75 * time.Minute, 1},
+		{125 * time.Minute, 0},
+	}
+	for i, v := range votes {
+		now := start.Add(v.at)
+		dal.now = func() time.Time { return now }
+		if err := dal.Answer(context.Background(), p.ID, []int64{cs[v.choice].ID}, "c:voter"+strconv.Itoa(i), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.MarginTimeline(w, httptest.NewRequest("GET", "/api/margin?poll_id="+strconv.FormatInt(p.ID, 10)+"&bucket=1h", nil))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+	var res struct {
+		Points []struct {
+			Time     time.Time `json:"time"`
+			LeaderID string    `json:"leader_id"`
+			Margin   int64     `json:"margin"`
+		} `json:"points"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	pizza, tacos := strconv.FormatInt(cs[0].ID, 10), strconv.FormatInt(cs[1].ID, 10)
+	want := []struct {
+		hour   int
+		leader string
+		margin int64
+	}{{10, pizza, 2}, {11, tacos, 1}, {12, "", 0}}
+	if len(res.Points) != len(want) {
+		t.Fatalf("points = %+v, want %d", res.Points, len(want))
+	}
+	for i, w := range want {
+		got := res.Points[i]
+		if got.Time.Hour() != w.hour || got.LeaderID != w.leader || got.Margin != w.margin {
+			t.Errorf("point %d = %+v, want %d:00 led by %q by %d", i, got, w.hour, w.leader, w.margin)
+		}
+	}
+}
+
+func TestPurgeOrphanAnswers(t *testing.T) {
+	_, dal := newTestApp(t)
+	ctx := context.Background()
+	lunch, lunchChoices := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	dinner, dinnerChoices := createTestPoll(t, dal, "Dinner?", "Soup", "Stew")
+	for i := 0; i < 2; i++ {
+		voter := "c:voter" + strconv.Itoa(i)
+		if err := dal.Answer(ctx, lunch.ID, []int64{lunchChoices[i].ID}, voter, ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+		if err := dal.Answer(ctx, dinner.ID, []int64{dinnerChoices[i].ID}, voter, ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	// As if deleted by hand without cascading: dinner's poll row, and one
+	// of lunch's choices, go while their answers stay.
+	delete(dal.polls, dinner.ID)
+	delete(dal.choices, lunchChoices[1].ID)
+
+	purged, err := dal.PurgeOrphanAnswers(ctx)
+	if err != nil {
+		t.Fatalf("PurgeOrphanAnswers: %v", err)
+	}
+	if purged != 3 {
+		t.Errorf("purged %d answers, want the 3 orphans", purged)
+	}
+	if len(dal.answers) != 1 || dal.answers[0].ChoiceID != lunchChoices[0].ID {
+		t.Errorf("answers left = %+v, want only the vote for Pizza", dal.answers)
+	}
+
+	if purged, _ := dal.PurgeOrphanAnswers(ctx); purged != 0 {
+		t.Errorf("purging again removed %d answers, want 0", purged)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	_, dal := newTestApp(t)
+	ctx := context.Background()
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos", "Sushi")
+	dal.polls[p.ID].MaxSelections = 2
+	dal.polls[p.ID].CacheResults = true
+
+	var voter int
+	vote := func(choices ...int) {
+		t.Helper()
+		voter++
+		var ids []int64
+		for _, c := range choices {
+			ids = append(ids, cs[c].ID)
+		}
+		if err := dal.Answer(ctx, p.ID, ids, "c:voter"+strconv.Itoa(voter), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+	tally := func(cached bool) (string, int64) {
+		t.Helper()
+		dal.polls[p.ID].CacheResults = cached
+		defer func() { dal.polls[p.ID].CacheResults = true }()
+
+		res, err := dal.GetResults(ctx, p.ID, byVotes)
+		if err != nil {
+			t.Fatalf("GetResults: %v", err)
+		}
+		var counts []string
+		for _, s := range res.Summaries {
+			counts = append(counts, s.Answer+"="+strconv.FormatInt(s.Count, 10))
+		}
+		return strings.Join(counts, ","), res.VoterCount
+	}
+
+	vote(0)
+	vote(0, 1)
+	vote(2)
+
+	// Until first refreshed, cached polls are tallied live.
+	if got, voters := tally(true); got != "Pizza=2,Tacos=1,Sushi=1" || voters != 3 {
+		t.Errorf("before refresh = %s from %d voters, want live counts", got, voters)
+	}
+
+	if err := dal.RefreshResultCache(ctx, p.ID); err != nil {
+		t.Fatalf("RefreshResultCache: %v", err)
+	}
+	live, liveVoters := tally(false)
+	cached, cachedVoters := tally(true)
+	if cached != live || cachedVoters != liveVoters {
+		t.Errorf("cached = %s from %d voters, live = %s from %d", cached, cachedVoters, live, liveVoters)
+	}
+
+	// New votes only show once the cache is refreshed again.
+	vote(2)
+	vote(2, 1)
+	if got, _ := tally(true); got != cached {
+		t.Errorf("stale cache = %s, want %s until refreshed", got, cached)
+	}
+	if err := dal.RefreshResultCaches(ctx); err != nil {
+		t.Fatalf("RefreshResultCaches: %v", err)
+	}
+	if got, voters := tally(true); got != "Sushi=3,Pizza=2,Tacos=2" || voters != 5 {
+		t.Errorf("after refresh = %s from %d voters, want Sushi=3,Pizza=2,Tacos=2 from 5", got, voters)
+	}
+}
+
+func TestDeletePollCascades(t *testing.T) {
+	a, dal := newTestApp(t)
+	ctx := context.Background()
+	lunch, lunchChoices := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	dinner, dinnerChoices := createTestPoll(t, dal, "Dinner?", "Soup", "Stew")
+	for _, v := range []struct {
+		poll   int64
+		choice int64
+	}{{lunch.ID, lunchChoices[0].ID}, {dinner.ID, dinnerChoices[0].ID}} {
+		if err := dal.Answer(ctx, v.poll, []int64{v.choice}, "c:voter", ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+	if err := dal.RecordImpressions(ctx, map[int64]int64{lunchChoices[0].ID: 1, dinnerChoices[0].ID: 1}); err != nil {
+		t.Fatalf("RecordImpressions: %v", err)
+	}
+	if err := dal.SetOpen(ctx, lunch.ID, false); err != nil {
+		t.Fatalf("SetOpen: %v", err)
+	}
+
+	w := adminPost(a, a.Delete, "/admin/delete", url.Values{"poll_id": {strconv.FormatInt(lunch.ID, 10)}})
+	if w.Code != 204 {
+		t.Fatalf("status = %d, want 204; body %q", w.Code, w.Body.String())
+	}
+
+	if _, err := dal.GetByID(ctx, lunch.ID); err != notFound {
+		t.Errorf("GetByID after delete err = %v, want notFound", err)
+	}
+	for _, c := range lunchChoices {
+		if _, ok := dal.choices[c.ID]; ok {
+			t.Errorf("choice %q survived", c.Answer)
+		}
+		if _, ok := dal.impressions[c.ID]; ok {
+			t.Errorf("impressions of %q survived", c.Answer)
+		}
+	}
+	if _, ok := dal.snapshots[lunch.ID]; ok {
+		t.Error("snapshot survived")
+	}
+	if len(dal.answers) != 1 || dal.answers[0].PollID != dinner.ID || len(dal.ballotTimes) != 1 {
+		t.Errorf("answers left = %+v, want only dinner's", dal.answers)
+	}
+	if _, ok := dal.impressions[dinnerChoices[0].ID]; !ok {
+		t.Error("another poll's impressions were deleted")
+	}
+
+	if w := adminPost(a, a.Delete, "/admin/delete", url.Values{"poll_id": {strconv.FormatInt(lunch.ID, 10)}}); w.Code != 404 {
+		t.Errorf("deleting again status = %d, want 404", w.Code)
+	}
+}
+
+func TestAnswerChoiceMismatch(t *testing.T) {
+	a, dal := newTestApp(t)
+	lunch, _ := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	_, dinnerChoices := createTestPoll(t, dal, "Dinner?", "Soup", "Stew")
+
+	vote := func(pollID, choiceID int64) *httptest.ResponseRecorder {
+		cookie, _ := voterCookieFor(t)
+		body := `{"poll_id": "` + strconv.FormatInt(pollID, 10) + `", "choice_id": "` + strconv.FormatInt(choiceID, 10) + `"}`
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		a.Answer(w, r)
+		return w
+	}
+
+	w := vote(lunch.ID, dinnerChoices[0].ID)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "That choice isn't part of this poll") {
+		t.Errorf("another poll's choice: status = %d, body %q; want 422 saying so", w.Code, w.Body.String())
+	}
+	if w := vote(lunch.ID, 999); w.Code != 404 {
+		t.Errorf("unknown choice status = %d, want 404", w.Code)
+	}
+	if w := vote(999, 998); w.Code != 404 {
+		t.Errorf("unknown poll and choice status = %d, want 404", w.Code)
+	}
+
+	if p, _ := dal.GetByID(context.Background(), lunch.ID); p.VoteCount != 0 {
+		t.Errorf("vote_count = %d, want 0", p.VoteCount)
+	}
+}
+
+func TestRenamePersists(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+
+	w := adminPost(a, a.Rename, "/polls/rename", url.Values{"poll_id": {strconv.FormatInt(p.ID, 10)}, "name": {"Dinner?"}})
+	if w.Code != 200 {
+		t.Fatalf("rename status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+	if got, _ := dal.GetByID(context.Background(), p.ID); got.Name != "Dinner?" {
+		t.Errorf("name after rename = %q, want Dinner?", got.Name)
+	}
+
+	w = httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/api/results?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+	if !strings.Contains(w.Body.String(), `"name":"Dinner?"`) {
+		t.Errorf("results = %q, want the new name", w.Body.String())
+	}
+
+	w = adminPost(a, a.UpdateChoice, "/choices/update", url.Values{"choice_id": {strconv.FormatInt(cs[0].ID, 10)}, "answer": {"Soup"}})
+	if w.Code != 200 {
+		t.Fatalf("update choice status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+	if cs, _, _ := dal.GetChoices(context.Background(), p.ID); cs[0].Answer != "Soup" {
+		t.Errorf("answer after update = %q, want Soup", cs[0].Answer)
+	}
+}
+
+func TestRenameAndUpdateMissing(t *testing.T) {
+	a, _ := newTestApp(t)
+
+	if w := adminPost(a, a.Rename, "/polls/rename", url.Values{"poll_id": {"999"}, "name": {"Dinner?"}}); w.Code != 404 {
+		t.Errorf("renaming a missing poll status = %d, want 404", w.Code)
+	}
+	if w := adminPost(a, a.UpdateChoice, "/choices/update", url.Values{"choice_id": {"999"}, "answer": {"Soup"}}); w.Code != 404 {
+		t.Errorf("updating a missing choice status = %d, want 404", w.Code)
+	}
+}
+
+func TestResultsSortOrder(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos", "Sushi")
+	var voter int
+	for i, n := range []int{1, 3, 2} {
+		for j := 0; j < n; j++ {
+			voter++
+			if err := dal.Answer(context.Background(), p.ID, []int64{cs[i].ID}, "c:voter"+strconv.Itoa(voter), ""); err != nil {
+				t.Fatalf("Answer: %v", err)
+			}
+		}
+	}
+
+	order := func(query string) string {
+		w := httptest.NewRecorder()
+		a.Results(w, httptest.NewRequest("GET", "/api/results?poll_id="+strconv.FormatInt(p.ID, 10)+query, nil))
+		var res struct {
+			Summaries []struct {
+				Answer string `json:"answer"`
+			} `json:"summaries"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		var answers []string
+		for _, s := range res.Summaries {
+			answers = append(answers, s.Answer)
+		}
+		return strings.Join(answers, ",")
+	}
+
+	for _, tt := range []struct{ query, want string }{
+		{"", "Tacos,Sushi,Pizza"},
+		{"&sort=votes", "Tacos,Sushi,Pizza"},
+		{"&sort=order", "Pizza,Tacos,Sushi"},
+	} {
+		if got := order(tt.query); got != tt.want {
+			t.Errorf("results%s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	// Closed polls read from their snapshot, sorted the same way.
+	if err := dal.SetOpen(context.Background(), p.ID, false); err != nil {
+		t.Fatalf("SetOpen: %v", err)
+	}
+	if got := order("&sort=order"); got != "Pizza,Tacos,Sushi" {
+		t.Errorf("closed results by order = %s, want Pizza,Tacos,Sushi", got)
+	}
+	if got := order("&sort=votes"); got != "Tacos,Sushi,Pizza" {
+		t.Errorf("closed results by votes = %s, want Tacos,Sushi,Pizza", got)
+	}
+}
+
+func TestResultsCSV(t *testing.T) {
+	a, dal := newTestApp(t)
+	p, cs := createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos, soft", "Sushi")
+	for i, c := range []int{1, 1, 1, 0} {
+		if err := dal.Answer(context.Background(), p.ID, []int64{cs[c].ID}, "c:voter"+strconv.Itoa(i), ""); err != nil {
+			t.Fatalf("Answer: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/results.csv?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Content-Type = %q, want text/csv", ct)
+	}
+	if cd, want := w.Header().Get("Content-Disposition"), `attachment; filename="poll-`+strconv.FormatInt(p.ID, 10)+`.csv"`; cd != want {
+		t.Errorf("Content-Disposition = %q, want %q", cd, want)
+	}
+
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	want := [][]string{
+		{"answer", "votes", "percentage"},
+		{"Tacos, soft", "3", "0.750"},
+		{"Pizza", "1", "0.250"},
+		{"Sushi", "0", "0.000"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("rows = %q, want %q", rows, want)
+	}
+	for i := range want {
+		if strings.Join(rows[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/results.csv?poll_id=999", nil))
+	if w.Code != 404 {
+		t.Errorf("unknown poll status = %d, want 404", w.Code)
+	}
+}
+
+func TestIndexShufflesDeterministically(t *testing.T) {
+	a, dal := newTestApp(t)
+	a.ShuffleSeed = func() int64 { return 42 }
+	answers := []string{"Pizza", "Tacos", "Sushi", "Soup", "Salad", "Stew"}
+	p, cs := createTestPoll(t, dal, "Lunch?", answers...)
+	dal.polls[p.ID].ShuffleChoices = true
+
+	want := append([]*choice(nil), cs...)
+	shuffleChoices(want, 42)
+	var shuffled []string
+	for _, c := range want {
+		shuffled = append(shuffled, c.Answer)
+	}
+	if strings.Join(shuffled, ",") == strings.Join(answers, ",") {
+		t.Fatal("seed 42 leaves the choices in order; pick another")
+	}
+
+	// choiceOrder lists the choices in the order the page shows them,
+	// checking each keeps its own id.
+	choiceOrder := func() string {
+		w := httptest.NewRecorder()
+		a.Index(w, httptest.NewRequest("GET", "/?poll_id="+strconv.FormatInt(p.ID, 10), nil))
+		if w.Code != 200 {
+			t.Fatalf("status = %d, want 200", w.Code)
+		}
+		body := w.Body.String()
+
+		var order []string
+		for {
+			at := strings.Index(body, `name="choice_id"`)
+			if at < 0 {
+				break
+			}
+			body = body[at+len(`name="choice_id"`):]
+			line := body[:strings.Index(body, "</p>")]
+			for _, c := range cs {
+				if strings.HasSuffix(line, " "+c.Answer) {
+					if !strings.Contains(line, `value="`+strconv.FormatInt(c.ID, 10)+`"`) {
+						t.Errorf("%s is listed with the wrong id: %q", c.Answer, line)
+					}
+					order = append(order, c.Answer)
+				}
+			}
+		}
+		return strings.Join(order, ",")
+	}
+
+	first := choiceOrder()
+	if first != strings.Join(shuffled, ",") {
+		t.Errorf("choices = %s, want %s", first, strings.Join(shuffled, ","))
+	}
+	if again := choiceOrder(); again != first {
+		t.Errorf("choices with the same seed = %s, then %s", first, again)
+	}
+
+	res, err := dal.GetResults(context.Background(), p.ID, byChoiceOrder)
+	if err != nil {
+		t.Fatalf("GetResults: %v", err)
+	}
+	for i, s := range res.Summaries {
+		if s.Answer != answers[i] {
+			t.Errorf("result %d = %s, want %s as created", i, s.Answer, answers[i])
+		}
+	}
+}
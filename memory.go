@@ -0,0 +1,1020 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inMemoryDAL is a pollDALer backed by maps and slices instead of
+// Postgres, for exercising handlers without a database. It follows the SQL
+// implementation's semantics, including which errors are returned when, but
+// keeps nothing across restarts.
+type inMemoryDAL struct {
+	mu sync.Mutex
+
+	polls       map[int64]*poll
+	choices     map[int64]*choice
+	answers     []*memoryAnswer
+	impressions map[int64]int64
+	events      []*event
+	synonyms    synonyms
+	snapshots   map[int64][]byte
+
+	// resultCache is poll_result_cache: the tallies of polls flagged with
+	// cache_results as of their last refresh, by poll id.
+	resultCache map[int64]*cachedResult
+
+	// ballotTimes is when each ballot was first cast, by BallotID.
+	ballotTimes map[int64]time.Time
+
+	lastID int64
+
+	// timezone is the zone used when bucketing votes by time of day.
+	timezone *time.Location
+
+	// maxChoices is the most choices GetChoices will return for a poll.
+	maxChoices int
+
+	// now is the clock rows are timestamped with.
+	now func() time.Time
+}
+
+var _ pollDALer = (*inMemoryDAL)(nil)
+
+// cachedResult is a poll's rows of poll_result_cache.
+type cachedResult struct {
+	counts map[int64]int64 // by choice id
+	voters int64
+}
+
+type memoryAnswer struct {
+	ID        int64
+	BallotID  int64 // shared by the answers of one vote
+	ChoiceID  int64
+	PollID    int64
+	VoterID   string
+	Region    string
+	CreatedAt time.Time
+}
+
+func newInMemoryDAL(timezone string, maxChoices int) *inMemoryDAL {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	return &inMemoryDAL{
+		polls:       make(map[int64]*poll),
+		choices:     make(map[int64]*choice),
+		impressions: make(map[int64]int64),
+		synonyms:    make(synonyms),
+		snapshots:   make(map[int64][]byte),
+		resultCache: make(map[int64]*cachedResult),
+		ballotTimes: make(map[int64]time.Time),
+		timezone:    loc,
+		maxChoices:  maxChoices,
+		now:         func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// AddSynonym maps synonym to canonical for AnswerByText, like a row of
+// answer_synonyms.
+func (d *inMemoryDAL) AddSynonym(synonym, canonical string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.synonyms[normalizeAnswer(synonym)] = normalizeAnswer(canonical)
+}
+
+func (d *inMemoryDAL) nextID() int64 {
+	d.lastID++
+	return d.lastID
+}
+
+func (d *inMemoryDAL) recordEvent(kind string, payload interface{}) {
+	raw, _ := json.Marshal(payload)
+	d.events = append(d.events, &event{ID: d.nextID(), Kind: kind, Payload: raw, CreatedAt: d.now()})
+}
+
+// sortedPolls returns copies of the polls for which keep is true, newest
+// first.
+func (d *inMemoryDAL) sortedPolls(keep func(*poll) bool) []*poll {
+	var polls []*poll
+	for _, p := range d.polls {
+		if keep(p) {
+			cp := *p
+			polls = append(polls, &cp)
+		}
+	}
+	sort.Slice(polls, func(i, j int) bool {
+		if !polls[i].CreatedAt.Equal(polls[j].CreatedAt) {
+			return polls[i].CreatedAt.After(polls[j].CreatedAt)
+		}
+		return polls[i].ID > polls[j].ID
+	})
+	return polls
+}
+
+// pollChoices returns pollId's choices in creation order.
+func (d *inMemoryDAL) pollChoices(pollId int64) []*choice {
+	var choices []*choice
+	for _, c := range d.choices {
+		if c.PollID == pollId {
+			choices = append(choices, c)
+		}
+	}
+	sort.Slice(choices, func(i, j int) bool { return choices[i].ID < choices[j].ID })
+	return choices
+}
+
+// pollAnswers returns the answers to pollId's choices in the order they
+// were cast.
+func (d *inMemoryDAL) pollAnswers(pollId int64) []*memoryAnswer {
+	var answers []*memoryAnswer
+	for _, a := range d.answers {
+		if c, ok := d.choices[a.ChoiceID]; ok && c.PollID == pollId {
+			answers = append(answers, a)
+		}
+	}
+	return answers
+}
+
+// votesByChoice counts the answers to each of pollId's choices.
+func (d *inMemoryDAL) votesByChoice(pollId int64) map[int64]int64 {
+	counts := make(map[int64]int64)
+	for _, a := range d.pollAnswers(pollId) {
+		counts[a.ChoiceID]++
+	}
+	return counts
+}
+
+func (d *inMemoryDAL) GetByID(ctx context.Context, pollId int64) (*poll, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.polls[pollId]
+	if !ok {
+		return nil, notFound
+	}
+	cp := *p
+	return &cp, nil
+}
+
+func (d *inMemoryDAL) GetLatest(ctx context.Context) (*poll, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	polls := d.sortedPolls(func(p *poll) bool { return p.IsOpen })
+	if len(polls) == 0 {
+		return nil, notFound
+	}
+	return polls[0], nil
+}
+
+func (d *inMemoryDAL) GetMostRecent(ctx context.Context) (*poll, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	polls := d.sortedPolls(func(p *poll) bool { return true })
+	if len(polls) == 0 {
+		return nil, notFound
+	}
+	return polls[0], nil
+}
+
+func (d *inMemoryDAL) GetChoices(ctx context.Context, pollId int64) ([]*choice, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var choices []*choice
+	for _, c := range d.pollChoices(pollId) {
+		cp := *c
+		choices = append(choices, &cp)
+	}
+
+	if len(choices) > d.maxChoices {
+		return choices[:d.maxChoices], true, nil
+	}
+	return choices, false, nil
+}
+
+func (d *inMemoryDAL) GetResults(ctx context.Context, pollId int64, order resultOrder) (*result, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.polls[pollId]
+	if !ok {
+		return nil, notFound
+	}
+	cp := *p
+
+	if raw, ok := d.snapshots[pollId]; ok && !p.IsOpen {
+		return decodeSnapshot(ctx, &cp, raw, order)
+	}
+
+	if cached, ok := d.resultCache[pollId]; ok && p.CacheResults {
+		return d.cachedResults(ctx, &cp, cached, order), nil
+	}
+
+	return d.liveResults(ctx, &cp, order), nil
+}
+
+// cachedResults reads p's result from cached, leaving out choices added
+// since it was refreshed like the join with choices does.
+func (d *inMemoryDAL) cachedResults(ctx context.Context, p *poll, cached *cachedResult, order resultOrder) *result {
+	var summaries []*summary
+	for _, c := range d.pollChoices(p.ID) {
+		if n, ok := cached.counts[c.ID]; ok {
+			summaries = append(summaries, &summary{choice: *c, Count: n})
+		}
+	}
+
+	if order != byChoiceOrder {
+		sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].Count > summaries[j].Count })
+	}
+
+	res := newResult(ctx, p, summaries)
+	res.VoterCount = cached.voters
+	return res
+}
+
+// liveResults tallies p's result from its answers.
+func (d *inMemoryDAL) liveResults(ctx context.Context, p *poll, order resultOrder) *result {
+	pollId := p.ID
+	counts := d.votesByChoice(pollId)
+	var summaries []*summary
+	for _, c := range d.pollChoices(pollId) {
+		summaries = append(summaries, &summary{choice: *c, Count: counts[c.ID]})
+	}
+
+	if order != byChoiceOrder {
+		sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].Count > summaries[j].Count })
+	}
+
+	res := newResult(ctx, p, summaries)
+	ballots := make(map[int64]bool)
+	for _, a := range d.pollAnswers(pollId) {
+		if !ballots[a.BallotID] {
+			ballots[a.BallotID] = true
+			res.VoterCount++
+		}
+	}
+
+	return res
+}
+
+func (d *inMemoryDAL) Answer(ctx context.Context, pollId int64, choiceIds []int64, voterID, region string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.answer(pollId, choiceIds, voterID, region)
+}
+
+func (d *inMemoryDAL) answer(pollId int64, choiceIds []int64, voterID, region string) error {
+	choiceIds = uniqueIDs(choiceIds)
+
+	p, ok := d.polls[pollId]
+	if !ok {
+		return notFound
+	} else if !p.IsOpen || d.expired(p) {
+		return errClosed
+	} else if p.Paused {
+		return errPaused
+	} else if len(choiceIds) < 1 || len(choiceIds) > p.MaxSelections {
+		return errSelectionCount
+	}
+
+	for _, choiceId := range choiceIds {
+		c, ok := d.choices[choiceId]
+		if !ok {
+			return notFound
+		} else if c.PollID != pollId {
+			return errChoiceMismatch
+		}
+	}
+
+	now := d.now()
+
+	// A voter who already voted may only replace their vote, keeping
+	// their ballot, while it's still changeable.
+	var ballot int64
+	if voterID != "" {
+		var kept []*memoryAnswer
+		var withdrawn int64
+		for _, a := range d.answers {
+			if a.PollID != pollId || a.VoterID != voterID {
+				kept = append(kept, a)
+				continue
+			}
+			if now.Sub(d.ballotTimes[a.BallotID]) >= time.Duration(p.VoteChangeWindow)*time.Second {
+				return errAlreadyVoted
+			}
+			ballot = a.BallotID
+			withdrawn++
+		}
+
+		if withdrawn > 0 {
+			d.answers = kept
+			p.VoteCount -= withdrawn
+			d.recordEvent("vote_withdrawn", map[string]int64{
+				"poll_id": pollId,
+				"answers": withdrawn,
+			})
+		}
+	}
+	if ballot == 0 {
+		ballot = d.nextID()
+		d.ballotTimes[ballot] = now
+	}
+	for _, choiceId := range choiceIds {
+		d.answers = append(d.answers, &memoryAnswer{
+			ID:        d.nextID(),
+			BallotID:  ballot,
+			ChoiceID:  choiceId,
+			PollID:    pollId,
+			VoterID:   voterID,
+			Region:    region,
+			CreatedAt: now,
+		})
+		p.VoteCount++
+
+		d.recordEvent("vote_cast", map[string]int64{
+			"poll_id":   pollId,
+			"choice_id": choiceId,
+		})
+	}
+	return nil
+}
+
+func (d *inMemoryDAL) AnswerByText(ctx context.Context, pollId int64, answerText, voterID, region string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return notFound
+	}
+
+	choices := d.pollChoices(pollId)
+	if len(choices) > d.maxChoices {
+		return errTooManyChoices
+	}
+
+	want := d.synonyms.canonical(answerText)
+	var match *choice
+	for _, c := range choices {
+		if d.synonyms.canonical(c.Answer) != want {
+			continue
+		}
+		if match != nil {
+			return errAmbiguousChoice
+		}
+		match = c
+	}
+
+	if match == nil {
+		return errNoMatchingChoice
+	}
+
+	return d.answer(pollId, []int64{match.ID}, voterID, region)
+}
+
+func (d *inMemoryDAL) GetVotesByHourOfDay(ctx context.Context, pollId int64) ([24]int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var hours [24]int64
+	if _, ok := d.polls[pollId]; !ok {
+		return hours, notFound
+	}
+
+	for _, a := range d.pollAnswers(pollId) {
+		hours[a.CreatedAt.In(d.timezone).Hour()]++
+	}
+	return hours, nil
+}
+
+func (d *inMemoryDAL) GetResultsDelta(ctx context.Context, pollId int64, since time.Time) ([]*delta, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return nil, notFound
+	}
+
+	byChoice := make(map[int64]*delta)
+	var deltas []*delta
+	for _, c := range d.pollChoices(pollId) {
+		dl := &delta{ChoiceID: c.ID, Answer: c.Answer}
+		byChoice[c.ID] = dl
+		deltas = append(deltas, dl)
+	}
+
+	for _, a := range d.pollAnswers(pollId) {
+		dl := byChoice[a.ChoiceID]
+		dl.Count++
+		if !a.CreatedAt.Before(since) {
+			dl.Change++
+		}
+	}
+
+	for _, dl := range deltas {
+		if before := dl.Count - dl.Change; before > 0 {
+			dl.RelativeChange = float64(dl.Change) / float64(before)
+		}
+	}
+	return deltas, nil
+}
+
+func (d *inMemoryDAL) RecordImpressions(ctx context.Context, counts map[int64]int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Like the foreign key, refuse impressions of unknown choices.
+	for choiceId := range counts {
+		if _, ok := d.choices[choiceId]; !ok {
+			return errConstraint
+		}
+	}
+
+	for choiceId, count := range counts {
+		d.impressions[choiceId] += count
+	}
+	return nil
+}
+
+func (d *inMemoryDAL) GetCTR(ctx context.Context, pollId int64) ([]*ctr, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return nil, notFound
+	}
+
+	votes := d.votesByChoice(pollId)
+	var ctrs []*ctr
+	for _, c := range d.pollChoices(pollId) {
+		r := &ctr{ChoiceID: c.ID, Answer: c.Answer, Impressions: d.impressions[c.ID], Votes: votes[c.ID]}
+		if r.Impressions > 0 {
+			r.Rate = float64(r.Votes) / float64(r.Impressions)
+		}
+		ctrs = append(ctrs, r)
+	}
+	return ctrs, nil
+}
+
+func (d *inMemoryDAL) GetEvents(ctx context.Context, limit, offset int) ([]*event, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var events []*event
+	for i := len(d.events) - 1 - offset; i >= 0 && len(events) < limit; i-- {
+		e := *d.events[i]
+		events = append(events, &e)
+	}
+	return events, nil
+}
+
+func (d *inMemoryDAL) ListPolls(ctx context.Context, limit, offset int) ([]*poll, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	polls := d.sortedPolls(func(p *poll) bool { return true })
+	if offset >= len(polls) {
+		return nil, nil
+	}
+	polls = polls[offset:]
+	if len(polls) > limit {
+		polls = polls[:limit]
+	}
+	return polls, nil
+}
+
+func (d *inMemoryDAL) ListPollsByOwner(ctx context.Context, owner string, limit, offset int) ([]*poll, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	polls := d.sortedPolls(func(p *poll) bool { return p.Owner == owner })
+	if offset >= len(polls) {
+		return nil, nil
+	}
+	polls = polls[offset:]
+	if len(polls) > limit {
+		polls = polls[:limit]
+	}
+	return polls, nil
+}
+
+func (d *inMemoryDAL) ReconcileVoteCounts(ctx context.Context) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var fixed int64
+	for _, p := range d.polls {
+		n := int64(len(d.pollAnswers(p.ID)))
+		if p.VoteCount != n {
+			p.VoteCount = n
+			fixed++
+		}
+	}
+	return fixed, nil
+}
+
+func (d *inMemoryDAL) CloseAllPolls(ctx context.Context) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var closed int64
+	for _, p := range d.polls {
+		if p.IsOpen {
+			p.IsOpen = false
+			closed++
+		}
+	}
+
+	d.recordEvent("all_polls_closed", map[string]int64{
+		"closed": closed,
+	})
+	return closed, nil
+}
+
+func (d *inMemoryDAL) CloseExpiredPolls(ctx context.Context) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var closed int64
+	for _, p := range d.polls {
+		if p.IsOpen && d.expired(p) {
+			p.IsOpen = false
+			closed++
+		}
+	}
+
+	if closed > 0 {
+		d.recordEvent("expired_polls_closed", map[string]int64{
+			"closed": closed,
+		})
+	}
+	return closed, nil
+}
+
+// expired reports whether p's close_at has passed.
+func (d *inMemoryDAL) expired(p *poll) bool {
+	return p.CloseAt != nil && !d.now().Before(*p.CloseAt)
+}
+
+func (d *inMemoryDAL) GetEmptyPolls(ctx context.Context, olderThan time.Duration) ([]*poll, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cutoff := d.now().Add(-olderThan)
+	polls := d.sortedPolls(func(p *poll) bool {
+		return p.CreatedAt.Before(cutoff) && len(d.pollAnswers(p.ID)) == 0
+	})
+
+	// Oldest first.
+	for i, j := 0, len(polls)-1; i < j; i, j = i+1, j-1 {
+		polls[i], polls[j] = polls[j], polls[i]
+	}
+	return polls, nil
+}
+
+func (d *inMemoryDAL) PausePoll(ctx context.Context, pollId int64) error {
+	return d.setPaused(pollId, true)
+}
+
+func (d *inMemoryDAL) ResumePoll(ctx context.Context, pollId int64) error {
+	return d.setPaused(pollId, false)
+}
+
+func (d *inMemoryDAL) setPaused(pollId int64, paused bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.polls[pollId]
+	if !ok {
+		return notFound
+	}
+	p.Paused = paused
+
+	kind := "poll_resumed"
+	if paused {
+		kind = "poll_paused"
+	}
+	d.recordEvent(kind, map[string]int64{
+		"poll_id": pollId,
+	})
+	return nil
+}
+
+func (d *inMemoryDAL) GetResultsByRegion(ctx context.Context, pollId int64) ([]*regionResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return nil, notFound
+	}
+
+	counts := make(map[string]map[int64]int64)
+	for _, a := range d.pollAnswers(pollId) {
+		if counts[a.Region] == nil {
+			counts[a.Region] = make(map[int64]int64)
+		}
+		counts[a.Region][a.ChoiceID]++
+	}
+
+	var regions []*regionResult
+	for region, byChoice := range counts {
+		rr := &regionResult{Region: region}
+		for choiceId, n := range byChoice {
+			rr.Summaries = append(rr.Summaries, &summary{choice: *d.choices[choiceId], Count: n})
+			rr.Count += n
+		}
+		sort.Slice(rr.Summaries, func(i, j int) bool {
+			if rr.Summaries[i].Count != rr.Summaries[j].Count {
+				return rr.Summaries[i].Count > rr.Summaries[j].Count
+			}
+			return rr.Summaries[i].ID < rr.Summaries[j].ID
+		})
+		for _, s := range rr.Summaries {
+			s.Percentage = percentage(s.Count, rr.Count)
+		}
+		regions = append(regions, rr)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Region < regions[j].Region })
+
+	return regions, nil
+}
+
+// bucketStart truncates t to the start of its bucket, counting buckets from
+// the Unix epoch like the SQL implementation does.
+func bucketStart(t time.Time, bucket time.Duration) time.Time {
+	secs := bucket.Seconds()
+	return time.Unix(int64(math.Floor(float64(t.Unix())/secs)*secs), 0).UTC()
+}
+
+func (d *inMemoryDAL) GetMarginTimeline(ctx context.Context, pollId int64, bucket time.Duration) ([]*marginPoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return nil, notFound
+	}
+
+	answers := d.pollAnswers(pollId)
+	sort.SliceStable(answers, func(i, j int) bool { return answers[i].CreatedAt.Before(answers[j].CreatedAt) })
+
+	var points []*marginPoint
+	totals := make(map[int64]int64)
+
+	for _, a := range answers {
+		t := bucketStart(a.CreatedAt, bucket)
+		if len(points) == 0 || !points[len(points)-1].Time.Equal(t) {
+			points = append(points, &marginPoint{Time: t})
+		}
+		totals[a.ChoiceID]++
+		points[len(points)-1].LeaderID, points[len(points)-1].Margin = leader(totals)
+	}
+
+	return points, nil
+}
+
+func (d *inMemoryDAL) GetVoteTimeline(ctx context.Context, pollId int64, bucket time.Duration) ([]*timelineBucket, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return nil, notFound
+	}
+
+	answers := d.pollAnswers(pollId)
+	sort.SliceStable(answers, func(i, j int) bool { return answers[i].CreatedAt.Before(answers[j].CreatedAt) })
+
+	var buckets []*timelineBucket
+	var total int64
+
+	for _, a := range answers {
+		t := bucketStart(a.CreatedAt, bucket)
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Time.Equal(t) {
+			buckets = append(buckets, &timelineBucket{Time: t})
+		}
+		total++
+		buckets[len(buckets)-1].Count++
+		buckets[len(buckets)-1].Total = total
+	}
+
+	return buckets, nil
+}
+
+func (d *inMemoryDAL) GetAnswerTimestamps(ctx context.Context, pollId int64) (map[int64][]time.Time, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return nil, notFound
+	}
+
+	answers := d.pollAnswers(pollId)
+	sort.SliceStable(answers, func(i, j int) bool { return answers[i].CreatedAt.Before(answers[j].CreatedAt) })
+
+	timestamps := make(map[int64][]time.Time)
+	for _, a := range answers {
+		timestamps[a.ChoiceID] = append(timestamps[a.ChoiceID], a.CreatedAt)
+	}
+
+	return timestamps, nil
+}
+
+func (d *inMemoryDAL) GetBallots(ctx context.Context, pollId int64) ([]*ballot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return nil, notFound
+	}
+
+	answers := d.pollAnswers(pollId)
+	sort.SliceStable(answers, func(i, j int) bool { return answers[i].CreatedAt.Before(answers[j].CreatedAt) })
+
+	var ballots []*ballot
+	byVoter := make(map[string]*ballot)
+	for _, a := range answers {
+		b, ok := byVoter[a.VoterID]
+		if !ok || a.VoterID == "" {
+			b = &ballot{VoterID: a.VoterID, CreatedAt: a.CreatedAt}
+			ballots = append(ballots, b)
+			if a.VoterID != "" {
+				byVoter[a.VoterID] = b
+			}
+		}
+		b.ChoiceIDs = append(b.ChoiceIDs, a.ChoiceID)
+	}
+
+	return ballots, nil
+}
+
+func (d *inMemoryDAL) GetVoterChoices(ctx context.Context, pollId int64, voterID string) ([]int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var choiceIds []int64
+	for _, a := range d.pollAnswers(pollId) {
+		if a.VoterID == voterID {
+			choiceIds = append(choiceIds, a.ChoiceID)
+		}
+	}
+	return choiceIds, nil
+}
+
+func (d *inMemoryDAL) PurgeOrphanAnswers(ctx context.Context) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var kept []*memoryAnswer
+	var purged int64
+	for _, a := range d.answers {
+		if c, ok := d.choices[a.ChoiceID]; ok {
+			if _, ok := d.polls[c.PollID]; ok {
+				kept = append(kept, a)
+				continue
+			}
+		}
+		purged++
+	}
+	d.answers = kept
+
+	d.recordEvent("orphan_answers_purged", map[string]int64{
+		"purged": purged,
+	})
+	return purged, nil
+}
+
+func (d *inMemoryDAL) RefreshResultCache(ctx context.Context, pollId int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.refreshResultCache(pollId)
+	return nil
+}
+
+func (d *inMemoryDAL) RefreshResultCaches(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, p := range d.polls {
+		if p.CacheResults {
+			d.refreshResultCache(p.ID)
+		}
+	}
+	return nil
+}
+
+// refreshResultCache replaces the cached tallies of pollId with its
+// current ones.
+func (d *inMemoryDAL) refreshResultCache(pollId int64) {
+	choices := d.pollChoices(pollId)
+	if len(choices) == 0 {
+		delete(d.resultCache, pollId)
+		return
+	}
+
+	counts := d.votesByChoice(pollId)
+	cached := &cachedResult{counts: make(map[int64]int64, len(choices))}
+	for _, c := range choices {
+		cached.counts[c.ID] = counts[c.ID]
+	}
+
+	ballots := make(map[int64]bool)
+	for _, a := range d.pollAnswers(pollId) {
+		ballots[a.BallotID] = true
+	}
+	cached.voters = int64(len(ballots))
+
+	d.resultCache[pollId] = cached
+}
+
+func (d *inMemoryDAL) CreatePoll(ctx context.Context, name string, choices []string, maxSelections int, owner string) (*poll, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Answers are unique within a poll, compared by normalizeAnswer.
+	seen := make(map[string]bool, len(choices))
+	for _, answer := range choices {
+		if seen[normalizeAnswer(answer)] {
+			return nil, errConstraint
+		}
+		seen[normalizeAnswer(answer)] = true
+	}
+
+	now := d.now()
+	p := &poll{ID: d.nextID(), Name: name, IsOpen: true, MaxSelections: maxSelections, Owner: owner, CreatedAt: now, ResultsVisibility: visibilityPublic}
+	d.polls[p.ID] = p
+
+	for _, answer := range choices {
+		c := &choice{ID: d.nextID(), PollID: p.ID, Answer: answer, CreatedAt: now}
+		d.choices[c.ID] = c
+	}
+
+	d.recordEvent("poll_created", map[string]interface{}{
+		"poll_id": p.ID,
+		"name":    name,
+		"choices": choices,
+		"owner":   owner,
+	})
+
+	cp := *p
+	return &cp, nil
+}
+
+func (d *inMemoryDAL) PollNameTaken(ctx context.Context, name string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, p := range d.polls {
+		if p.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (d *inMemoryDAL) SetOpen(ctx context.Context, pollId int64, open bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.polls[pollId]
+	if !ok {
+		return notFound
+	} else if p.IsOpen == open {
+		return nil
+	}
+	p.IsOpen = open
+
+	delete(d.snapshots, pollId)
+	if !open {
+		if p.CacheResults {
+			d.refreshResultCache(pollId)
+		}
+		cp := *p
+		raw, err := encodeSnapshot(d.liveResults(ctx, &cp, byVotes))
+		if err != nil {
+			return err
+		}
+		d.snapshots[pollId] = raw
+	}
+
+	kind := "poll_opened"
+	if !open {
+		kind = "poll_closed"
+	}
+	d.recordEvent(kind, map[string]int64{
+		"poll_id": pollId,
+	})
+	return nil
+}
+
+func (d *inMemoryDAL) DeletePoll(ctx context.Context, pollId int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return notFound
+	}
+
+	var kept []*memoryAnswer
+	for _, a := range d.answers {
+		if c, ok := d.choices[a.ChoiceID]; !ok || c.PollID != pollId {
+			kept = append(kept, a)
+		} else {
+			delete(d.ballotTimes, a.BallotID)
+		}
+	}
+	d.answers = kept
+
+	for _, c := range d.pollChoices(pollId) {
+		delete(d.impressions, c.ID)
+		delete(d.choices, c.ID)
+	}
+	delete(d.snapshots, pollId)
+	delete(d.resultCache, pollId)
+	delete(d.polls, pollId)
+
+	d.recordEvent("poll_deleted", map[string]int64{
+		"poll_id": pollId,
+	})
+	return nil
+}
+
+func (d *inMemoryDAL) RenamePoll(ctx context.Context, pollId int64, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.polls[pollId]
+	if !ok {
+		return notFound
+	}
+	p.Name = name
+
+	d.recordEvent("poll_renamed", map[string]interface{}{
+		"poll_id": pollId,
+		"name":    name,
+	})
+	return nil
+}
+
+func (d *inMemoryDAL) UpdateChoice(ctx context.Context, choiceId int64, answer string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.choices[choiceId]
+	if !ok {
+		return notFound
+	}
+
+	for _, other := range d.pollChoices(c.PollID) {
+		if other.ID != choiceId && normalizeAnswer(other.Answer) == normalizeAnswer(answer) {
+			return errConstraint
+		}
+	}
+	c.Answer = answer
+
+	d.recordEvent("choice_updated", map[string]interface{}{
+		"choice_id": choiceId,
+		"answer":    answer,
+	})
+	return nil
+}
+
+func (d *inMemoryDAL) AddChoice(ctx context.Context, pollId int64, answer string) (*choice, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.polls[pollId]; !ok {
+		return nil, notFound
+	}
+
+	for _, other := range d.pollChoices(pollId) {
+		if normalizeAnswer(other.Answer) == normalizeAnswer(answer) {
+			return nil, errConstraint
+		}
+	}
+
+	c := &choice{ID: d.nextID(), PollID: pollId, Answer: answer, CreatedAt: d.now()}
+	d.choices[c.ID] = c
+
+	d.recordEvent("choice_added", map[string]interface{}{
+		"poll_id":   pollId,
+		"choice_id": c.ID,
+		"answer":    answer,
+	})
+
+	cp := *c
+	return &cp, nil
+}
+
+func (d *inMemoryDAL) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics counts requests by handler and status and times them by handler,
+// and serves those along with database pool stats for Prometheus to scrape.
+type metrics struct {
+	requests  *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+
+	handler http.Handler
+}
+
+func newMetrics(dbStats func() sql.DBStats) *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Requests handled, by handler and status.",
+		}, []string{"handler", "status"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time taken to handle requests, by handler.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"handler"}),
+	}
+	openConns := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "db_open_connections",
+		Help: "Open database connections, in use or idle.",
+	}, func() float64 {
+		return float64(dbStats().OpenConnections)
+	})
+
+	// A registry of our own rather than the default one, so only what's
+	// registered here is exposed.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m.requests, m.durations, openConns)
+	m.handler = promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	return m
+}
+
+// Observe records a request to handler that finished with status after d.
+func (m *metrics) Observe(handler string, status int, d time.Duration) {
+	m.requests.WithLabelValues(handler, strconv.Itoa(status)).Inc()
+	m.durations.WithLabelValues(handler).Observe(d.Seconds())
+}
+
+// ServeHTTP writes the metrics in the Prometheus exposition format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	m.handler.ServeHTTP(w, r)
+}
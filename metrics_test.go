@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseSample parses a sample line of the Prometheus text format into its
+// metric name, unescaped labels and value.
+func parseSample(line string) (string, map[string]string, float64, error) {
+	labels := make(map[string]string)
+
+	open := strings.IndexByte(line, '{')
+	if open < 0 {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return "", nil, 0, fmt.Errorf("malformed sample %q", line)
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		return fields[0], labels, v, err
+	}
+
+	name, rest := line[:open], line[open+1:]
+	for {
+		if strings.HasPrefix(rest, "}") {
+			rest = rest[1:]
+			break
+		}
+
+		eq := strings.Index(rest, `="`)
+		if eq < 0 {
+			return "", nil, 0, fmt.Errorf("malformed labels in %q", line)
+		}
+		label := rest[:eq]
+		rest = rest[eq+2:]
+
+		var value strings.Builder
+		for {
+			if rest == "" {
+				return "", nil, 0, fmt.Errorf("unterminated label value in %q", line)
+			}
+			c := rest[0]
+			rest = rest[1:]
+			if c == '"' {
+				break
+			}
+			if c != '\\' {
+				value.WriteByte(c)
+				continue
+			}
+			if rest == "" {
+				return "", nil, 0, fmt.Errorf("dangling escape in %q", line)
+			}
+			switch rest[0] {
+			case '\\', '"':
+				value.WriteByte(rest[0])
+			case 'n':
+				value.WriteByte('\n')
+			default:
+				return "", nil, 0, fmt.Errorf("bad escape \\%c in %q", rest[0], line)
+			}
+			rest = rest[1:]
+		}
+		labels[label] = value.String()
+		rest = strings.TrimPrefix(rest, ",")
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(rest), 64)
+	return name, labels, v, err
+}
+
+func TestMetricsOutputParses(t *testing.T) {
+	m := newMetrics(func() sql.DBStats { return sql.DBStats{OpenConnections: 3} })
+
+	awkward := "/weird\"path\\with\nnewline"
+	m.Observe(awkward, 200, 30*time.Millisecond)
+	m.Observe("/results", 404, time.Millisecond)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	requests := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, labels, value, err := parseSample(line)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		if name == "http_requests_total" {
+			requests[labels["handler"]+" "+labels["status"]] = value
+		}
+		if name == "db_open_connections" && value != 3 {
+			t.Errorf("db_open_connections = %v, want 3", value)
+		}
+	}
+
+	if requests[awkward+" 200"] != 1 {
+		t.Errorf("awkward handler didn't round-trip: %v", requests)
+	}
+	if requests["/results 404"] != 1 {
+		t.Errorf("/results 404 missing: %v", requests)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// middleware wraps a handler with behaviour shared across routes, like
+// logging or panic recovery.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in mws, the first of which sees requests first.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// recoverPanics turns a panicking handler into a logged 500 rather than
+// letting it take down the process. The panic and its stack are always
+// logged; the 500 is only sent if the handler hadn't started its response.
+// http.ErrAbortHandler is re-raised, since net/http uses it to abort a
+// response deliberately.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			} else if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.Printf("in=recover request_id=%s method=%s path=%q err=%q stack=%q", requestID(r.Context()), r.Method, r.URL.Path, fmt.Sprint(err), debug.Stack())
+			if rec.status == 0 {
+				w.WriteHeader(500)
+				w.Write([]byte("Internal Server Error"))
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("db password is hunter2")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/results", nil))
+
+	if w.Code != 500 {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if body := w.Body.String(); body != "Internal Server Error" {
+		t.Errorf("body = %q, want only %q", body, "Internal Server Error")
+	}
+	if !strings.Contains(logs.String(), "hunter2") || !strings.Contains(logs.String(), "in=recover") {
+		t.Errorf("log = %q, want the panic logged", logs.String())
+	}
+
+	// Once the response has started, the status already sent stands.
+	h = recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("partial"))
+		panic("late")
+	}))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/results", nil))
+	if w.Code != 200 || w.Body.String() != "partial" {
+		t.Errorf("status = %d, body %q; want 200 and only what was written", w.Code, w.Body.String())
+	}
+}
+
+func TestRecoverPanicsReraisesAbort(t *testing.T) {
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", err)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
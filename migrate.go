@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"io/fs"
+	"log"
+	"sort"
+	"strings"
+)
+
+// migrationFiles are the schema migrations, applied in filename order, and
+// the only definition of the schema. Once deployed, a migration must never
+// be edited; add a new one instead. Each must tolerate finding its changes
+// already made, as databases created before migrations existed will have.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the advisory lock key serializing migrations, so dynos
+// booting together don't apply the same migration twice.
+const migrationLock = 8675309
+
+// runMigrations applies each migration not yet recorded in
+// schema_migrations, in its own transaction along with its record.
+func runMigrations(ctx context.Context, db *sql.DB, dialect dialect) error {
+	create := `CREATE TABLE IF NOT EXISTS schema_migrations (
+ version text PRIMARY KEY,
+ applied_at timestamp NOT NULL DEFAULT ` + dialect.Now() + `
+)`
+	if _, err := db.ExecContext(ctx, create); err != nil {
+		return err
+	}
+
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+
+	var versions []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".sql") {
+			versions = append(versions, e.Name())
+		}
+	}
+	sort.Strings(versions)
+
+	for _, version := range versions {
+		if err := applyMigration(ctx, db, dialect, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, dialect dialect, version string) error {
+	lockQuery := dialect.Rebind(`SELECT pg_advisory_xact_lock(?)`)
+	appliedQuery := dialect.Rebind(`SELECT count(*) FROM schema_migrations WHERE version = ?`)
+	recordQuery := dialect.Rebind(`INSERT INTO schema_migrations (version) VALUES (?)`)
+
+	raw, err := migrationFiles.ReadFile("migrations/" + version)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, lockQuery, migrationLock); err != nil {
+		return err
+	}
+
+	var applied int
+	if err := tx.QueryRowContext(ctx, appliedQuery, version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	log.Printf("in=runMigrations at=apply version=%s", version)
+	if _, err := tx.ExecContext(ctx, string(raw)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, recordQuery, version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/fs"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// unguarded matches DDL that fails when its change has already been made.
+var unguarded = regexp.MustCompile(`(?i)\b(CREATE (UNIQUE )?(TABLE|INDEX)|ADD COLUMN|DROP (CONSTRAINT|INDEX|TABLE|COLUMN))\s+(\w+)`)
+
+func TestMigrationsAreIdempotent(t *testing.T) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	for _, e := range entries {
+		raw, err := migrationFiles.ReadFile("migrations/" + e.Name())
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+
+		for _, stmt := range strings.Split(string(raw), ";") {
+			for _, m := range unguarded.FindAllStringSubmatch(stmt, -1) {
+				if strings.ToUpper(m[len(m)-1]) != "IF" {
+					t.Errorf("%s: %q isn't guarded with IF [NOT] EXISTS", e.Name(), m[0])
+				}
+			}
+			if strings.Contains(strings.ToUpper(stmt), "INSERT INTO") && !strings.Contains(strings.ToUpper(stmt), "ON CONFLICT") {
+				t.Errorf("%s: INSERT without ON CONFLICT", e.Name())
+			}
+		}
+	}
+}
+
+// TestNormalizedAnswersMigrationMergesFirst checks duplicates that would
+// fail the normalized answer index are merged before it's built.
+func TestNormalizedAnswersMigrationMergesFirst(t *testing.T) {
+	raw, err := migrationFiles.ReadFile("migrations/0008_normalized_answers.sql")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	sql := string(raw)
+
+	index := strings.Index(sql, "CREATE UNIQUE INDEX")
+	for _, step := range []string{
+		"UPDATE answers SET choice_id",
+		"INSERT INTO impressions",
+		"DELETE FROM poll_result_cache",
+		"DELETE FROM choices",
+	} {
+		if i := strings.Index(sql, step); i < 0 || i > index {
+			t.Errorf("%q doesn't come before the index is created", step)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+-- Databases created from the old schema/schema.sql already have some of
+-- these tables and columns, so everything here is created only if missing.
+
+CREATE TABLE IF NOT EXISTS polls (
+ id SERIAL PRIMARY KEY,
+ name text NOT NULL,
+ is_open boolean,
+ created_at timestamp
+);
+
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS paused boolean NOT NULL DEFAULT false;
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS vote_count bigint NOT NULL DEFAULT 0;
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS cache_results boolean NOT NULL DEFAULT false;
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS theme text NOT NULL DEFAULT 'default';
+
+CREATE TABLE IF NOT EXISTS choices (
+ id SERIAL PRIMARY KEY,
+ poll_id bigint REFERENCES polls (id),
+ answer text NOT NULL,
+ created_at timestamp
+);
+
+ALTER TABLE choices ADD COLUMN IF NOT EXISTS category text NOT NULL DEFAULT '';
+
+-- Named like the constraint UNIQUE (poll_id, answer) creates, so databases
+-- that already have it are left alone.
+CREATE UNIQUE INDEX IF NOT EXISTS choices_poll_id_answer_key ON choices (poll_id, answer);
+
+CREATE TABLE IF NOT EXISTS answers (
+ id SERIAL PRIMARY KEY,
+ choice_id bigint REFERENCES choices (id),
+ poll_id bigint REFERENCES polls (id),
+ voter_id text,
+ region text,
+ created_at timestamp,
+ UNIQUE (poll_id, voter_id)
+);
+
+ALTER TABLE answers ADD COLUMN IF NOT EXISTS poll_id bigint REFERENCES polls (id);
+ALTER TABLE answers ADD COLUMN IF NOT EXISTS voter_id text;
+ALTER TABLE answers ADD COLUMN IF NOT EXISTS region text;
+
+CREATE TABLE IF NOT EXISTS impressions (
+ choice_id bigint PRIMARY KEY REFERENCES choices (id),
+ count bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS events (
+ id SERIAL PRIMARY KEY,
+ kind text NOT NULL,
+ payload jsonb NOT NULL,
+ created_at timestamp
+);
+
+CREATE TABLE IF NOT EXISTS answer_synonyms (
+ synonym text PRIMARY KEY,
+ canonical text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS poll_result_cache (
+ choice_id bigint PRIMARY KEY REFERENCES choices (id),
+ poll_id bigint REFERENCES polls (id),
+ count bigint NOT NULL,
+ refreshed_at timestamp
+);
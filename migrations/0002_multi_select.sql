@@ -0,0 +1,15 @@
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS max_selections integer NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS ballots (
+ poll_id bigint REFERENCES polls (id),
+ voter_id text NOT NULL,
+ created_at timestamp,
+ PRIMARY KEY (poll_id, voter_id)
+);
+
+INSERT INTO ballots (poll_id, voter_id, created_at)
+ SELECT poll_id, voter_id, min(created_at) FROM answers
+ WHERE voter_id IS NOT NULL GROUP BY poll_id, voter_id
+ ON CONFLICT DO NOTHING;
+
+ALTER TABLE answers DROP CONSTRAINT IF EXISTS answers_poll_id_voter_id_key;
@@ -0,0 +1 @@
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS results_hidden boolean NOT NULL DEFAULT false;
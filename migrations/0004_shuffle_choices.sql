@@ -0,0 +1 @@
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS shuffle_choices boolean NOT NULL DEFAULT false;
@@ -0,0 +1,3 @@
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS owner text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS polls_owner_created_at_idx ON polls (owner, created_at);
@@ -0,0 +1 @@
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS close_at timestamptz;
@@ -0,0 +1 @@
+ALTER TABLE poll_result_cache ADD COLUMN IF NOT EXISTS voter_count bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,30 @@
+-- Answers are unique within a poll ignoring case and runs of whitespace,
+-- like normalizeAnswer compares them.
+
+-- Choices that differ only that way are merged into the oldest of them
+-- first, moving their votes and impressions along, so the index can be
+-- built.
+CREATE TEMPORARY TABLE IF NOT EXISTS choice_duplicates ON COMMIT DROP AS
+ SELECT id, min(id) OVER (PARTITION BY poll_id, lower(regexp_replace(btrim(answer), '\s+', ' ', 'g'))) AS keep
+ FROM choices;
+
+DELETE FROM choice_duplicates WHERE id = keep;
+
+UPDATE answers SET choice_id = d.keep
+ FROM choice_duplicates d WHERE answers.choice_id = d.id;
+
+INSERT INTO impressions (choice_id, count)
+ SELECT d.keep, sum(i.count) FROM impressions i
+ JOIN choice_duplicates d ON d.id = i.choice_id
+ GROUP BY d.keep
+ ON CONFLICT (choice_id) DO UPDATE SET count = impressions.count + EXCLUDED.count;
+
+DELETE FROM impressions WHERE choice_id IN (SELECT id FROM choice_duplicates);
+
+-- Cached tallies of merged choices are recomputed on the next refresh.
+DELETE FROM poll_result_cache WHERE choice_id IN (SELECT id FROM choice_duplicates);
+
+DELETE FROM choices WHERE id IN (SELECT id FROM choice_duplicates);
+
+CREATE UNIQUE INDEX IF NOT EXISTS choices_poll_id_normalized_answer_key
+ ON choices (poll_id, lower(regexp_replace(btrim(answer), '\s+', ' ', 'g')));
@@ -0,0 +1,7 @@
+-- Votes without a voter used to be recorded without a ballot. Voters are
+-- now counted by ballot, so give each such vote one. Its answers were
+-- inserted in one transaction and so share created_at.
+INSERT INTO ballots (poll_id, voter_id, created_at)
+ SELECT poll_id, 'anon:' || min(id), created_at FROM answers
+ WHERE voter_id IS NULL GROUP BY poll_id, created_at
+ ON CONFLICT DO NOTHING;
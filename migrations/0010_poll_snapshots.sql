@@ -0,0 +1,7 @@
+-- The result each poll closed with, written by SetOpen and discarded when
+-- the poll reopens.
+CREATE TABLE IF NOT EXISTS poll_snapshots (
+ poll_id bigint PRIMARY KEY REFERENCES polls (id),
+ result jsonb NOT NULL,
+ created_at timestamp
+);
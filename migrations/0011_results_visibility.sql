@@ -0,0 +1,2 @@
+-- Who may see a poll's results: public, owner or after_close.
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS results_visibility text NOT NULL DEFAULT 'public';
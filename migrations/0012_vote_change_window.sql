@@ -0,0 +1,2 @@
+-- Seconds after voting that a voter may replace their vote; 0 for never.
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS vote_change_window integer NOT NULL DEFAULT 0;
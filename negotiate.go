@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// negotiate picks the offered media type the client prefers according to
+// its Accept header. The first offer is the default, used when there is no
+// Accept header or nothing acceptable was offered.
+func negotiate(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	type accepted struct {
+		mediaType string
+		q         float64
+	}
+
+	var ranges []accepted
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		a := accepted{mediaType: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					a.q = q
+				}
+			}
+		}
+		if a.q > 0 {
+			ranges = append(ranges, a)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, a := range ranges {
+		for _, offer := range offers {
+			if mediaTypeMatches(a.mediaType, offer) {
+				return offer
+			}
+		}
+	}
+
+	return offers[0]
+}
+
+// mediaTypeMatches reports whether offer falls within the media range
+// pattern, which may use wildcards like */* or text/*.
+func mediaTypeMatches(pattern, offer string) bool {
+	if pattern == "*/*" || pattern == offer {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(offer, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows each client a fixed number of requests per window.
+// Windows start with a client's first request and are kept in memory;
+// Run periodically forgets clients whose window has ended.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	clients map[string]*rateWindow
+
+	// now is the clock windows are measured with.
+	now func() time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string]*rateWindow),
+		now:     time.Now,
+	}
+}
+
+// Allow counts a request from key, and reports whether it's within the
+// limit, how many more key may make in its window and how long until the
+// window ends.
+func (l *rateLimiter) Allow(key string) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	w, ok := l.clients[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.clients[key] = w
+	}
+
+	reset := w.start.Add(l.window).Sub(now)
+	if w.count >= l.limit {
+		return false, 0, reset
+	}
+	w.count++
+	return true, l.limit - w.count, reset
+}
+
+// Run forgets clients whose window has ended, every interval. It never
+// returns.
+func (l *rateLimiter) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mu.Lock()
+		now := l.now()
+		for key, w := range l.clients {
+			if now.Sub(w.start) >= l.window {
+				delete(l.clients, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Limit wraps next so clients, identified by IP, over the limit get a 429
+// instead, with Retry-After, X-RateLimit-Limit and X-RateLimit-Reset
+// headers. Clients that have used half their limit are sent
+// X-RateLimit-Remaining first, so well-behaved ones can slow down before
+// they're blocked. Resets are in seconds from now.
+func (l *rateLimiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, remaining, reset := l.Allow(clientIP(r))
+
+		seconds := int(math.Ceil(reset.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.limit))
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(seconds))
+			w.WriteHeader(429)
+			w.Write([]byte("Too Many Requests"))
+			return
+		}
+
+		if remaining*2 <= l.limit {
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		}
+
+		next(w, r)
+	}
+}
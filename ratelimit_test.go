@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	handler := l.Limit(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	request := func(fwd string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/answer", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if fwd != "" {
+			r.Header.Set("X-Forwarded-For", fwd)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("203.0.113.7"); w.Code != 204 {
+			t.Fatalf("request %d status = %d, want 204", i+1, w.Code)
+		}
+	}
+
+	w := request("203.0.113.7")
+	if w.Code != 429 {
+		t.Fatalf("over limit status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+
+	// A spoofed first hop doesn't earn a fresh window.
+	if w := request("198.51.100.1, 203.0.113.7"); w.Code != 429 {
+		t.Errorf("spoofed X-Forwarded-For status = %d, want 429", w.Code)
+	}
+
+	// Without the header, the peer address is its own client.
+	if w := request(""); w.Code != 204 {
+		t.Errorf("other client status = %d, want 204", w.Code)
+	}
+
+	now = now.Add(time.Minute)
+	if w := request("203.0.113.7"); w.Code != 204 {
+		t.Errorf("next window status = %d, want 204", w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		fwd, remote, want string
+	}{
+		{"", "10.0.0.1:1234", "10.0.0.1"},
+		{"203.0.113.7", "10.0.0.1:1234", "203.0.113.7"},
+		{"198.51.100.1, 203.0.113.7", "10.0.0.1:1234", "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/answer", nil)
+		r.RemoteAddr = tt.remote
+		if tt.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tt.fwd)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%q, %q) = %q, want %q", tt.fwd, tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(4, time.Minute)
+	l.now = func() time.Time { return now }
+
+	handler := l.Limit(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/answer", nil))
+		now = now.Add(10 * time.Second)
+		return w
+	}
+
+	// Nothing until half the limit is used, then a countdown.
+	for i, want := range []string{"", "2", "1", "0"} {
+		w := request()
+		if w.Code != 204 {
+			t.Fatalf("request %d status = %d, want 204", i+1, w.Code)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != want {
+			t.Errorf("request %d X-RateLimit-Remaining = %q, want %q", i+1, got, want)
+		}
+	}
+
+	w := request()
+	if w.Code != 429 {
+		t.Fatalf("over limit status = %d, want 429", w.Code)
+	}
+	for header, want := range map[string]string{
+		"X-RateLimit-Limit":     "4",
+		"X-RateLimit-Remaining": "0",
+		"X-RateLimit-Reset":     "20",
+		"Retry-After":           "20",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
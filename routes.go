@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// basePath is the prefix all routes are served under, like "/polls" when
+// mounted behind a proxy alongside other services. It's empty when served
+// from the root, and never ends in a slash.
+var basePath string
+
+// normalizeBasePath turns a BASE_PATH setting into a basePath: "", "/" and
+// "polls/" become "", "" and "/polls".
+func normalizeBasePath(p string) string {
+	p = strings.TrimRight(p, "/")
+	if p != "" && !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// withBasePath returns the URL of the route at p, which starts with a
+// slash, under basePath.
+func withBasePath(p string) string {
+	return basePath + p
+}
+
+// cookiePath is the Path of cookies we set, so they're only sent to routes
+// under basePath.
+func cookiePath() string {
+	if basePath == "" {
+		return "/"
+	}
+	return basePath
+}
+
+// stripBasePath returns middleware serving routes under basePath as though
+// they were at the root, so handlers and the mux never see the prefix.
+// Paths only sharing its leading characters, like /pollsX for /polls, are
+// not under it and aren't found.
+func stripBasePath(next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+
+	strip := http.StripPrefix(basePath, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The bare prefix is the index page.
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	})
+}
+
+// pathPollIDKey is the context key under which PollRoutes passes on the
+// poll id taken from the path.
+type pathPollIDKey struct{}
+
+// PollRoutes serves the shareable, path-based forms of the poll pages:
+// /polls/<id> for voting and /polls/<id>/results for results. They're
+// served by Index and Results just like their ?poll_id= equivalents.
+func (a *app) PollRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/polls/"), "/")
+
+	var next http.HandlerFunc
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		next = a.Index
+	case len(parts) == 2 && parts[0] != "" && parts[1] == "results":
+		next = a.Results
+	default:
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	next(w, r.WithContext(context.WithValue(r.Context(), pathPollIDKey{}, parts[0])))
+}
+
+// pollIDParam returns the raw poll id r refers to, from the path when
+// routed by PollRoutes and from the poll_id parameter otherwise.
+func pollIDParam(r *http.Request) string {
+	if id, ok := r.Context().Value(pathPollIDKey{}).(string); ok {
+		return id
+	}
+	return r.FormValue("poll_id")
+}
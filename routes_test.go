@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestStripBasePath(t *testing.T) {
+	basePath = "/polls"
+	defer func() { basePath = "" }()
+
+	var seen string
+	h := stripBasePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Path
+	}))
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		seen   string
+	}{
+		{"/polls/", 200, "/"},
+		{"/polls/results", 200, "/results"},
+		{"/polls", 301, ""},
+		{"/pollsX/results", 404, ""},
+		{"/pollster", 404, ""},
+		{"/results", 404, ""},
+	} {
+		seen = ""
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status || seen != tt.seen {
+			t.Errorf("%s: status = %d, handler saw %q; want %d and %q", tt.path, w.Code, seen, tt.status, tt.seen)
+		}
+	}
+}
+
+func TestPollRoutesMatchQueryForms(t *testing.T) {
+	a, dal := newTestApp(t)
+	createTestPoll(t, dal, "Lunch?", "Pizza", "Tacos")
+	p, _ := createTestPoll(t, dal, "Dinner?", "Soup", "Stew")
+	id := strconv.FormatInt(p.ID, 10)
+	cookie, _ := voterCookieFor(t)
+
+	get := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	for _, tt := range []struct {
+		path  string
+		query string
+		via   http.HandlerFunc
+	}{
+		{"/polls/" + id, "/?poll_id=" + id, a.Index},
+		{"/polls/" + id + "/results", "/results?poll_id=" + id, a.Results},
+	} {
+		byPath := get(a.PollRoutes, tt.path)
+		byQuery := get(tt.via, tt.query)
+		if byPath.Code != 200 || byQuery.Code != 200 {
+			t.Errorf("%s status = %d, %s status = %d; want 200", tt.path, byPath.Code, tt.query, byQuery.Code)
+			continue
+		}
+		if byPath.Body.String() != byQuery.Body.String() {
+			t.Errorf("%s and %s differ:\n%s\n%s", tt.path, tt.query, byPath.Body.String(), byQuery.Body.String())
+		}
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/polls/abc", 400},
+		{"/polls/abc/results", 400},
+		{"/polls/" + id + "/votes", 404},
+		{"/polls/", 404},
+	} {
+		if w := get(a.PollRoutes, tt.path); w.Code != tt.status {
+			t.Errorf("%s status = %d, want %d", tt.path, w.Code, tt.status)
+		}
+	}
+}
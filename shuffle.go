@@ -0,0 +1,22 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// shuffleChoices reorders cs at random, seeded by seed, so polls with
+// shuffle_choices don't favour whichever choice happens to be listed first.
+func shuffleChoices(cs []*choice, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(cs), func(i, j int) { cs[i], cs[j] = cs[j], cs[i] })
+}
+
+// shuffleSeed returns the seed for shuffling a page's choices: one from
+// ShuffleSeed when set, so tests get a fixed order, and the clock otherwise.
+func (a *app) shuffleSeed() int64 {
+	if a.ShuffleSeed != nil {
+		return a.ShuffleSeed()
+	}
+	return time.Now().UnixNano()
+}
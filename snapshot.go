@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// resultSnapshot is a closed poll's result as stored in poll_snapshots, so
+// it reads the same however choices and votes change afterwards. Only the
+// counts are kept; percentages, categories and entropy follow from them.
+type resultSnapshot struct {
+	Summaries  []snapshotSummary `json:"summaries"`
+	VoterCount int64             `json:"voter_count"`
+}
+
+type snapshotSummary struct {
+	ID        int64     `json:"id"`
+	PollID    int64     `json:"poll_id"`
+	Answer    string    `json:"answer"`
+	Category  string    `json:"category"`
+	CreatedAt time.Time `json:"created_at"`
+	Count     int64     `json:"count"`
+}
+
+// encodeSnapshot serializes res for poll_snapshots.
+func encodeSnapshot(res *result) ([]byte, error) {
+	snap := resultSnapshot{VoterCount: res.VoterCount}
+	for _, s := range res.Summaries {
+		snap.Summaries = append(snap.Summaries, snapshotSummary{
+			ID:        s.ID,
+			PollID:    s.PollID,
+			Answer:    s.Answer,
+			Category:  s.Category,
+			CreatedAt: s.CreatedAt,
+			Count:     s.Count,
+		})
+	}
+	return json.Marshal(snap)
+}
+
+// decodeSnapshot rebuilds p's result, listed in order, from a snapshot
+// encodeSnapshot wrote.
+func decodeSnapshot(ctx context.Context, p *poll, raw []byte, order resultOrder) (*result, error) {
+	var snap resultSnapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return nil, err
+	}
+
+	summaries := make([]*summary, 0, len(snap.Summaries))
+	for _, s := range snap.Summaries {
+		summaries = append(summaries, &summary{
+			choice: choice{ID: s.ID, PollID: s.PollID, Answer: s.Answer, Category: s.Category, CreatedAt: s.CreatedAt},
+			Count:  s.Count,
+		})
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if order == byVotes && summaries[i].Count != summaries[j].Count {
+			return summaries[i].Count > summaries[j].Count
+		}
+		return summaries[i].ID < summaries[j].ID
+	})
+
+	res := newResult(ctx, p, summaries)
+	res.VoterCount = snap.VoterCount
+	return res, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// staticAssets holds the stylesheets and other files served under
+// /static/, so pages don't depend on a third-party CDN.
+//
+//go:embed static
+var staticAssets embed.FS
+
+// staticHandler serves staticAssets under /static/. Assets only change with
+// a deploy, so they're cacheable for a day like theme stylesheets.
+func staticHandler() http.Handler {
+	sub, err := fs.Sub(staticAssets, "static")
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix("/static/", http.FileServer(http.FS(sub)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "GET", "HEAD") {
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			// No directory listings.
+			w.WriteHeader(404)
+			w.Write([]byte("Not Found"))
+			return
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		files.ServeHTTP(w, r)
+	})
+}
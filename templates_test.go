@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBuiltinTemplatesRender renders each embedded template with the data
+// its handler passes it.
+func TestBuiltinTemplatesRender(t *testing.T) {
+	dal := newInMemoryDAL("UTC", 1000)
+	p, cs := createTestPoll(t, dal, "Best colour?", "Red", "Blue", "Green")
+	if err := dal.Answer(context.Background(), p.ID, []int64{cs[0].ID}, "c:one", ""); err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+	res, err := dal.GetResults(context.Background(), p.ID, byVotes)
+	if err != nil {
+		t.Fatalf("GetResults: %v", err)
+	}
+
+	tests := []struct {
+		tmpl *template.Template
+		data interface{}
+		want string
+	}{
+		{layoutTmpl, struct {
+			Body       template.HTML
+			Title      string
+			Stylesheet string
+		}{Body: "<p>body</p>", Title: "Title", Stylesheet: themeStylesheet("")}, "<p>body</p>"},
+		{resultsTmpl, newResultsView(res, 2), "Other (1 choices)"},
+		{barsTmpl, newResultsView(res, 0), "Green"},
+		{indexTmpl, struct {
+			Poll      *poll
+			Choices   []*choice
+			Truncated bool
+			CSRFToken string
+			Selected  map[int64]bool
+		}{Poll: p, Choices: cs, CSRFToken: "token", Selected: map[int64]bool{cs[0].ID: true}}, `checked`},
+		{emptyTmpl, nil, ""},
+		{pollsTmpl, struct {
+			Polls []*poll
+			Owner string
+			Limit int
+			Prev  int
+			Next  int
+		}{Polls: []*poll{p}, Limit: 20, Prev: -1, Next: 20}, "Older"},
+		{hiddenTmpl, p, "Results are hidden"},
+	}
+
+	for _, tt := range tests {
+		var b strings.Builder
+		if err := tt.tmpl.Execute(&b, tt.data); err != nil {
+			t.Errorf("%s: Execute: %v", tt.tmpl.Name(), err)
+			continue
+		}
+		if b.Len() == 0 {
+			t.Errorf("%s rendered nothing", tt.tmpl.Name())
+		}
+		if !strings.Contains(b.String(), tt.want) {
+			t.Errorf("%s: output missing %q", tt.tmpl.Name(), tt.want)
+		}
+	}
+}
+
+func TestTemplateReloadFallsBackToBuiltin(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "empty.html"), []byte("custom landing"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	a := &app{TemplatesDir: dir, TemplateReload: true}
+
+	tmpl, err := a.template("empty")
+	if err != nil {
+		t.Fatalf("template(empty): %v", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, nil); err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if b.String() != "custom landing" {
+		t.Errorf("empty = %q, want the override", b.String())
+	}
+
+	tmpl, err = a.template("layout")
+	if err != nil {
+		t.Fatalf("template(layout): %v", err)
+	}
+	if tmpl != layoutTmpl {
+		t.Errorf("layout isn't the built-in template")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "polls.html"), []byte("{{"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := a.template("polls"); err == nil {
+		t.Errorf("template(polls) with a broken override succeeded")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// themes maps each non-default poll theme to the stylesheet layered on top
+// of the base styles. Themes are a fixed set rather than arbitrary CSS so
+// that poll data can never inject styles or markup.
+var themes = map[string]string{
+	"dark":         darkCSS,
+	"highcontrast": highContrastCSS,
+}
+
+// themeStylesheet returns the URL of the stylesheet for theme, or "" for
+// the default theme and any theme we don't know about.
+func themeStylesheet(theme string) string {
+	if _, ok := themes[theme]; !ok {
+		return ""
+	}
+	return withBasePath("/themes/" + theme + ".css")
+}
+
+// Theme serves the stylesheets for poll themes under /themes/.
+func (a *app) Theme(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/themes/"), ".css")
+	css, ok := themes[name]
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write([]byte(css))
+}
+
+const darkCSS = `
+body { background: #1e1e24; color: #e6e6ea; }
+a { color: #9d8df1; }
+input, button { background: #2c2c35; color: #e6e6ea; border-color: #44444f; }
+`
+
+const highContrastCSS = `
+body { background: #000; color: #fff; font-size: 120%; }
+a { color: #ff0; text-decoration: underline; }
+input, button { background: #000; color: #fff; border: 2px solid #fff; }
+`
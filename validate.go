@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxPollNameLen = 200
+	maxAnswerLen   = 500
+)
+
+var errTooFewChoices = errors.New("a poll needs at least 2 choices")
+
+// errDuplicateAnswer describes a choice whose answer, compared by
+// normalizeAnswer, another choice of its poll already has.
+var errDuplicateAnswer = errors.New("poll already has that answer")
+
+// validatePoll trims the name and answers of a new poll and checks them,
+// returning an error describing the first problem found.
+func validatePoll(name string, answers []string) (string, []string, error) {
+	name, err := validatePollName(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(answers) < 2 {
+		return "", nil, errTooFewChoices
+	}
+
+	seen := make(map[string]bool, len(answers))
+	trimmed := make([]string, 0, len(answers))
+	for _, a := range answers {
+		a, err := validateAnswer(a)
+		if err != nil {
+			return "", nil, err
+		}
+
+		key := normalizeAnswer(a)
+		if seen[key] {
+			return "", nil, fmt.Errorf("choice %q is listed more than once", a)
+		}
+		seen[key] = true
+		trimmed = append(trimmed, a)
+	}
+
+	return name, trimmed, nil
+}
+
+// validatePollName trims a poll name and checks it isn't blank or too long.
+func validatePollName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", errors.New("poll name can't be blank")
+	case utf8.RuneCountInString(name) > maxPollNameLen:
+		return "", fmt.Errorf("poll name can't be longer than %d characters", maxPollNameLen)
+	}
+	return name, nil
+}
+
+// validateAnswer trims a choice's answer and checks it isn't blank or too
+// long.
+func validateAnswer(answer string) (string, error) {
+	answer = strings.TrimSpace(answer)
+	switch {
+	case answer == "":
+		return "", errors.New("choices can't be blank")
+	case utf8.RuneCountInString(answer) > maxAnswerLen:
+		return "", fmt.Errorf("choices can't be longer than %d characters", maxAnswerLen)
+	}
+	return answer, nil
+}
+
+// validateMaxSelections checks a poll with the given number of choices lets
+// voters pick at least one and at most all of them.
+func validateMaxSelections(maxSelections, choices int) error {
+	if maxSelections < 1 || maxSelections > choices {
+		return fmt.Errorf("max selections must be between 1 and %d", choices)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePoll(t *testing.T) {
+	atName := strings.Repeat("n", maxPollNameLen)
+	atAnswer := strings.Repeat("a", maxAnswerLen)
+
+	tests := []struct {
+		desc    string
+		name    string
+		answers []string
+		ok      bool
+	}{
+		{"valid", "Lunch?", []string{"Pizza", "Tacos"}, true},
+		{"name at limit", atName, []string{"Pizza", "Tacos"}, true},
+		{"name one over", atName + "n", []string{"Pizza", "Tacos"}, false},
+		{"multibyte name at limit", strings.Repeat("é", maxPollNameLen), []string{"Pizza", "Tacos"}, true},
+		{"whitespace name", " \t\n ", []string{"Pizza", "Tacos"}, false},
+		{"answer at limit", "Lunch?", []string{atAnswer, "Tacos"}, true},
+		{"answer one over", "Lunch?", []string{atAnswer + "a", "Tacos"}, false},
+		{"whitespace answer", "Lunch?", []string{"Pizza", "   "}, false},
+		{"padding doesn't count", "Lunch?", []string{"  " + atAnswer + "  ", "Tacos"}, true},
+		{"one answer", "Lunch?", []string{"Pizza"}, false},
+		{"duplicate answer", "Lunch?", []string{"Pizza", " pizza "}, false},
+	}
+
+	for _, tt := range tests {
+		_, _, err := validatePoll(tt.name, tt.answers)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.desc, err, tt.ok)
+		}
+	}
+}
+
+func TestValidatePollTrims(t *testing.T) {
+	name, answers, err := validatePoll("  Lunch? ", []string{" Pizza", "Tacos\n"})
+	if err != nil {
+		t.Fatalf("validatePoll: %v", err)
+	}
+	if name != "Lunch?" || answers[0] != "Pizza" || answers[1] != "Tacos" {
+		t.Errorf("got %q, %q", name, answers)
+	}
+}
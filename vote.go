@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+)
+
+// maxVoteBody caps the size of JSON vote bodies.
+const maxVoteBody = 64 << 10
+
+// voteRequest is a vote as posted to /answer, either form-encoded or as a
+// JSON body like {"poll_id": 1, "choice_id": 2}.
+type voteRequest struct {
+	PollID    publicID   `json:"poll_id"`
+	ChoiceID  publicID   `json:"choice_id"`
+	ChoiceIDs []publicID `json:"choice_ids"`
+	Answer    string     `json:"answer"`
+	CSRFToken string     `json:"csrf_token"`
+}
+
+// publicID is an id as handed out by ids. In JSON it may be a string or,
+// when ids aren't signed, a plain number.
+type publicID string
+
+func (p *publicID) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*p = publicID(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return errors.New("ids must be strings or numbers")
+	}
+	*p = publicID(n)
+	return nil
+}
+
+// isJSON reports whether r's body is JSON.
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// parseVote reads the vote posted in r, from its JSON body when it has one
+// and from its form otherwise. Unknown JSON fields are rejected.
+func parseVote(w http.ResponseWriter, r *http.Request) (*voteRequest, error) {
+	if !isJSON(r) {
+		r.ParseForm()
+		v := &voteRequest{
+			PollID:    publicID(pollIDParam(r)),
+			Answer:    r.PostFormValue("answer"),
+			CSRFToken: r.PostFormValue(csrfField),
+		}
+		// Multi-select polls send a choice_id per selected choice.
+		for _, raw := range r.Form["choice_id"] {
+			v.ChoiceIDs = append(v.ChoiceIDs, publicID(raw))
+		}
+		return v, nil
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVoteBody))
+	dec.DisallowUnknownFields()
+
+	v := &voteRequest{}
+	if err := dec.Decode(v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after vote")
+	}
+
+	if v.ChoiceID != "" {
+		v.ChoiceIDs = append([]publicID{v.ChoiceID}, v.ChoiceIDs...)
+	}
+	return v, nil
+}
+
+// decodeIDs decodes each of raw as an id of kind.
+func decodeIDs(kind string, raw []publicID) ([]int64, error) {
+	var decoded []int64
+	for _, s := range raw {
+		id, err := ids.Decode(kind, string(s))
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, id)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestJSONVoteFlow votes the way an API client would: with the ids and
+// voter cookie from /api/results, and no CSRF token.
+func TestJSONVoteFlow(t *testing.T) {
+	ids.key = []byte("test signing key")
+	defer func() { ids.key = nil }()
+
+	a, dal := newTestApp(t)
+	p, _ := createTestPoll(t, dal, "Best colour?", "Red", "Blue")
+
+	w := httptest.NewRecorder()
+	a.Results(w, httptest.NewRequest("GET", "/api/results?poll_id="+ids.Encode("poll", p.ID), nil))
+	if w.Code != 200 {
+		t.Fatalf("results status = %d, want 200; body %q", w.Code, w.Body.String())
+	}
+
+	var res struct {
+		Poll struct {
+			ID string `json:"id"`
+		} `json:"poll"`
+		Summaries []struct {
+			ID     string `json:"id"`
+			PollID string `json:"poll_id"`
+		} `json:"summaries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if res.Poll.ID != ids.Encode("poll", p.ID) {
+		t.Fatalf("poll id = %q, want %q", res.Poll.ID, ids.Encode("poll", p.ID))
+	}
+	if len(res.Summaries) != 2 || res.Summaries[0].PollID != res.Poll.ID {
+		t.Fatalf("summaries = %+v", res.Summaries)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != voterCookie {
+		t.Fatalf("cookies = %v, want a voter cookie", cookies)
+	}
+
+	vote := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		body := `{"poll_id": "` + res.Poll.ID + `", "choice_id": "` + res.Summaries[0].ID + `"}`
+		r := httptest.NewRequest("POST", "/answer", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		a.Answer(w, r)
+		return w
+	}
+
+	if w := vote(nil); w.Code != 403 {
+		t.Errorf("vote without cookie status = %d, want 403", w.Code)
+	}
+
+	w = vote(cookies[0])
+	if w.Code != 201 {
+		t.Fatalf("vote status = %d, want 201; body %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// voterCookie names the cookie identifying a visitor, so each visitor only
+// gets one vote per poll.
+const voterCookie = "voter"
+
+// voterSigner issues and verifies voter cookies of the form "token.mac".
+type voterSigner struct {
+	key []byte
+}
+
+// voters is the signer used by handlers, keyed from VOTER_COOKIE_SECRET at
+// startup.
+var voters = &voterSigner{}
+
+// Issue returns a new signed voter cookie value.
+func (v *voterSigner) Issue() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(b)
+	return token + "." + v.mac("cookie:"+token), nil
+}
+
+// Verify returns the token of a signed cookie value, or false if the value
+// was tampered with.
+func (v *voterSigner) Verify(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+
+	token, sum := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sum), []byte(v.mac("cookie:"+token))) {
+		return "", false
+	}
+	return token, true
+}
+
+func (v *voterSigner) mac(s string) string {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// voterID identifies whoever sent r by their voter cookie, or returns false
+// if it has no valid one. Votes are only accepted with a valid cookie, as
+// CSRF checks need one too, so there's no fallback to identify voters by.
+func voterID(r *http.Request) (string, bool) {
+	token, ok := voterToken(r)
+	if !ok {
+		return "", false
+	}
+	return "c:" + token, true
+}
+
+// voterToken returns the token of r's voter cookie, or false if it has no
+// valid one.
+func voterToken(r *http.Request) (string, bool) {
+	c, err := r.Cookie(voterCookie)
+	if err != nil {
+		return "", false
+	}
+	return voters.Verify(c.Value)
+}
+
+// ensureVoterCookie gives r's sender a voter cookie unless they already have
+// a valid one, and returns its token.
+func ensureVoterCookie(w http.ResponseWriter, r *http.Request) (string, error) {
+	if token, ok := voterToken(r); ok {
+		return token, nil
+	}
+
+	value, err := voters.Issue()
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     voterCookie,
+		Value:    value,
+		Path:     cookiePath(),
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+	})
+
+	token, _ := voters.Verify(value)
+	return token, nil
+}
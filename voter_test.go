@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVoterCookiePath(t *testing.T) {
+	defer func() { basePath = "" }()
+
+	for _, tt := range []struct{ basePath, want string }{
+		{"", "/"},
+		{"/polls", "/polls"},
+	} {
+		basePath = tt.basePath
+
+		w := httptest.NewRecorder()
+		if _, err := ensureVoterCookie(w, httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatalf("ensureVoterCookie: %v", err)
+		}
+
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Path != tt.want {
+			t.Errorf("basePath %q: cookies = %v, want Path %q", tt.basePath, cookies, tt.want)
+		}
+	}
+}